@@ -6,18 +6,31 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"math"
+	"os"
 	"path"
+	"strings"
+	"time"
 
 	"aqwari.net/net/styx"
-	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
 // 9p server container - implements interfaces for styx
 type Server struct {
 	*File
-	container azblob.ContainerURL
+	backend   Backend // Storage holding the blobs
 	ctx       context.Context
+	recursive bool                // Remove directories along with everything beneath them
+	readAhead int64               // Bytes to read ahead of ranged reads
+	dirtyMax  int64               // Buffered bytes which force an upload, 0 for no limit
+	idle      time.Duration       // Quiet time after which writes are uploaded, 0 to wait for clunk
+	blockSize int64               // Size of blocks staged for changed bytes, 0 uploads whole blobs
+	blobType  BlobType            // Type of newly created blobs
+	typeRules map[string]BlobType // Name suffixes choosing the type of new blobs
+	ttl       time.Duration       // How long a directory listing is trusted before listing again
+	cache     *Cache              // Contents kept on disk, nil for none
 }
 
 // Init the server and its file system - call only once
@@ -25,101 +38,281 @@ func (s *Server) Initialize() {
 	s.File = NewTree(s)
 }
 
-// Look up a file by path string
-func lookup(srv Server, full string) (*File, error) {
-	// Sync root
-	srv.File.Sync()
+// Type of blob to create for a new file, append-only files are always append blobs
+// Otherwise the longest matching suffix rule wins over the server default
+func (srv *Server) newBlobType(name string, mode os.FileMode) BlobType {
+	if mode&os.ModeAppend != 0 {
+		return AppendBlob
+	}
+
+	typ, longest := srv.blobType, -1
+	for suffix, t := range srv.typeRules {
+		if strings.HasSuffix(name, suffix) && len(suffix) > longest {
+			typ, longest = t, len(suffix)
+		}
+	}
+
+	if typ == "" {
+		return BlockBlob
+	}
+
+	return typ
+}
 
+// Look up a file by path string
+func lookup(srv *Server, full string) (*File, error) {
 	cleaned := path.Clean(full)
 
 	// Short circuit base case for root
 	if cleaned == "/" {
+		err := srv.File.Revalidate()
+		if err != nil {
+			return nil, err
+		}
+
 		return srv.File, nil
 	}
 
-	f, err := srv.File.Search(cleaned)
-	if f == nil {
-		return srv.File, err
+	// Sync each directory on the way, if stale or never listed, so remote additions are visible
+	return srv.File.resolve(cleaned, true)
+}
+
+// Failures a client can act on, replied with their 9p error string
+var errors9P = []error{
+	os.ErrNotExist,   // `file does not exist`
+	os.ErrExist,      // `file already exists`
+	os.ErrPermission, // `permission denied`
+	ErrNotDir,
+	ErrNotEmpty,
+	ErrConflict,
+}
+
+// The error to reply with for err, a known failure however it was reached, otherwise what went wrong as `what err`
+func error9P(what string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	for _, known := range errors9P {
+		if errors.Is(err, known) {
+			return known
+		}
+	}
+
+	if what == "" {
+		return err
 	}
 
-	return f, err
+	return errors.New(what + " " + err.Error())
+}
+
+// Relist stale directories every interval until the server's context ends
+// Only blobs whose ETag or modification time changed are updated
+func (srv *Server) Refresh(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-srv.ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		// Directories not yet listed wait for first use
+		srv.File.walk(func(f *File) {
+			if f.dir && !f.listed() {
+				return
+			}
+
+			if err := f.Revalidate(); err != nil {
+				log.Println("!!!! refresh of", f.Path(), "failed - ", err)
+			}
+		})
+	}
 }
 
 // Handle 9p requests to the server - each new connection will call this
 func (srv *Server) Serve9P(s *styx.Session) {
-Loop:
 	for s.Next() {
-		msg := s.Request()
-		file := path.Clean(msg.Path())
-		log.Println("Handling: ", file)
-
-		// Switch on the kind of message we are receiving, not all will arrive here and are handled by styx
-		// Only every give styx a VFile to ensure it can cast interfaces correctly
-		switch t := msg.(type) {
-		case styx.Twalk:
-			log.Println("=== walk: ", t)
-			f, err := lookup(*srv, file)
-			t.Rwalk(f.VF(), err)
-
-		case styx.Topen:
-			log.Println("=== open: ", t)
-			f, err := lookup(*srv, file)
-			t.Ropen(f.VF(), err)
-
-		case styx.Tstat:
-			log.Println("=== stat: ", t)
-			f, err := lookup(*srv, file)
-			t.Rstat(f.VF(), err)
-
-		case styx.Tcreate:
-			log.Println("=== create: ", t)
-			// TODO - something special for directories?
-			full := file + t.Name
-
-			// Insert into file tree
-			f, err := srv.File.Insert(full, false)
-			if err != nil {
-				t.Rerror("tree insert failed %s", err)
-				continue Loop
-			}
+		srv.handle(s.Request())
+	}
+}
+
+// Answer a single 9p request
+func (srv *Server) handle(msg styx.Request) {
+	file := path.Clean(msg.Path())
+	log.Println("Handling: ", file)
+
+	// Switch on the kind of message we are receiving, not all will arrive here and are handled by styx
+	// Only every give styx a VFile, or a Listing for an open directory, to ensure it can cast interfaces correctly
+	// Every case replies exactly once, errors go through error9P
+	switch t := msg.(type) {
+	case styx.Twalk:
+		log.Println("=== walk: ", t)
+		f, err := lookup(srv, file)
+		if err != nil {
+			t.Rwalk(nil, error9P("", err))
+			return
+		}
+
+		t.Rwalk(f.VF(), nil)
 
-			// Upload to blob storage
-			err = f.Blob.Upload(srv.ctx)
+	case styx.Topen:
+		log.Println("=== open: ", t)
+		f, err := lookup(srv, file)
+		if err != nil {
+			t.Ropen(nil, error9P("", err))
+			return
+		}
+
+		// Opening with OTRUNC empties the file first
+		if t.Flag&os.O_TRUNC != 0 && !f.dir {
+			err = f.Truncate(0)
 			if err != nil {
-				t.Rerror("azure upload failed %s", err)
-				continue Loop
+				t.Ropen(nil, error9P("truncate failed", err))
+				return
 			}
+		}
 
-			t.Rcreate(f.VF(), nil)
+		t.Ropen(f.open(), nil)
 
-		case styx.Tremove:
-			log.Println("=== rm: ", t)
-			full := t.Path()
-			f, err := lookup(*srv, full)
+	case styx.Tstat:
+		log.Println("=== stat: ", t)
+		f, err := lookup(srv, file)
+		if err != nil {
+			t.Rstat(nil, error9P("", err))
+			return
+		}
 
-			// Delete from blob storage
-			// TODO - verify delete snapshot options
-			_, err = f.Blob.url.Delete(srv.ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
-			if err != nil {
-				t.Rerror("azure delete failed %s", err)
+		t.Rstat(f.VF(), nil)
+
+	case styx.Tcreate:
+		log.Println("=== create: ", t)
+		full := t.NewPath()
+		isDir := t.Mode.IsDir()
+
+		// Existing blobs must be seen first, the directory may never have been listed
+		dir, err := lookup(srv, path.Dir(full))
+		if err == nil {
+			err = dir.Revalidate()
+		}
+		if err != nil {
+			t.Rerror("%s", error9P("", err))
+			return
+		}
+
+		// Insert into file tree
+		f, err := srv.File.Insert(full, isDir)
+		if err != nil {
+			t.Rerror("%s", error9P("tree insert failed", err))
+			return
+		}
+
+		// Upload to blob storage, directories persist as a marker blob
+		if isDir {
+			err = f.Blob.Mark(srv.ctx)
+		} else {
+			err = f.Blob.Create(srv.ctx, srv.newBlobType(t.Name, t.Mode))
+		}
+		if err != nil {
+			// A blob created since the directory was listed stays, as the remote has it
+			if !isDir && errors.Is(err, os.ErrExist) {
+				asked := time.Now()
+				info, serr := srv.backend.Stat(srv.ctx, f.Blob.key())
+				if serr == nil {
+					dir.syncChild(t.Name, false, info, asked)
+				} else {
+					srv.File.Delete(full)
+				}
+			} else {
+				srv.File.Delete(full)
 			}
 
-			// Delete from file tree
-			err = srv.File.Delete(full)
+			t.Rerror("%s", error9P("backend upload failed", err))
+			return
+		}
+
+		t.Rcreate(f.open(), nil)
+
+	case styx.Tremove:
+		log.Println("=== rm: ", t)
+		full := t.Path()
+		f, err := lookup(srv, full)
+		if err != nil {
+			t.Rremove(error9P("", err))
+			return
+		}
+
+		// Delete from blob storage
+		if f.dir {
+			err = f.RemoveDir(srv.recursive)
+		} else {
+			err = f.Blob.Delete(srv.ctx)
+		}
+
+		// Rremove releases the fid even when reporting an error
+		if err != nil {
+			t.Rremove(error9P("backend delete failed", err))
+			return
+		}
+
+		// Delete from file tree, a remote delete may have beaten us to it
+		srv.File.Delete(full)
+
+		t.Rremove(nil)
+
+	case styx.Trename:
+		log.Println("=== rename: ", t)
+		f, err := lookup(srv, t.OldPath)
+		if err != nil {
+			t.Rrename(error9P("", err))
+			return
+		}
 
-			t.Rremove(err)
+		// 9p names carry no slashes, renames stay within the directory
+		dest := path.Join(path.Dir(t.OldPath), t.NewPath)
 
-		case styx.Ttruncate:
-			// TODO
-			log.Println("=== truncate?: ", t)
+		t.Rrename(error9P("", f.Rename(dest)))
 
-		case styx.Tutimes:
-			// Change last modified time
-			log.Println("=== utimes?: ", t)
-			// TODO
+	case styx.Ttruncate:
+		log.Println("=== truncate: ", t)
+		f, err := lookup(srv, file)
+		if err != nil {
+			t.Rtruncate(error9P("", err))
+			return
+		}
+
+		t.Rtruncate(error9P("", f.Truncate(t.Size)))
+
+	case styx.Tutimes:
+		// Change last modified time, access times are not kept
+		log.Println("=== utimes: ", t)
+		f, err := lookup(srv, file)
+		if err != nil {
+			t.Rutimes(error9P("", err))
+			return
+		}
+
+		// A "don't touch" mtime arrives as the maximum 32-bit time
+		if t.Mtime.Unix() == math.MaxUint32 {
 			t.Rutimes(nil)
+			return
+		}
+
+		t.Rutimes(error9P("", f.SetModTime(t.Mtime)))
 
+	case styx.Tsync:
+		// A wstat changing nothing asks for buffered writes to be committed
+		log.Println("=== sync: ", t)
+		f, err := lookup(srv, file)
+		if err != nil {
+			t.Rsync(error9P("", err))
+			return
 		}
+
+		t.Rsync(error9P("", f.Flush()))
+
 	}
 }
 
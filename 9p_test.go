@@ -0,0 +1,2721 @@
+// Copyright (c) 2020 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aqwari.net/net/styx/styxproto"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// Fetch a blob straight from the backend
+func blobData(t *testing.T, store Backend, name string) []byte {
+	t.Helper()
+
+	data, _, err := store.Get(context.Background(), name, 0, -1)
+	if err != nil {
+		t.Fatalf("could not get blob %q - %v", name, err)
+	}
+
+	return data
+}
+
+func TestCreateReadWrite(t *testing.T) {
+	store := NewMemBackend()
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	want := []byte("hello, world\n")
+	if err := c.createFile("/hello", want); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+
+	got, err := c.readFile("/hello")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+
+	if got := blobData(t, store, "hello"); !bytes.Equal(got, want) {
+		t.Errorf("blob holds %q, want %q", got, want)
+	}
+}
+
+func TestLargeWrite(t *testing.T) {
+	store := NewMemBackend()
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	// Spans several 9p messages
+	want := bytes.Repeat([]byte("0123456789abcdef"), 2000)
+	if err := c.createFile("/big", want); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+
+	got, err := c.readFile("/big")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes back, want %d", len(got), len(want))
+	}
+}
+
+func TestStat(t *testing.T) {
+	store := NewMemBackend()
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	if err := c.createFile("/stat", []byte("12345")); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+
+	stat, err := c.statFile("/stat")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+
+	if name := string(stat.Name()); name != "stat" {
+		t.Errorf("name is %q, want %q", name, "stat")
+	}
+	if stat.Length() != 5 {
+		t.Errorf("length is %d, want 5", stat.Length())
+	}
+	if stat.Qid().Type()&0x80 != 0 {
+		t.Error("regular file reported as a directory")
+	}
+
+	root, err := c.statFile("/")
+	if err != nil {
+		t.Fatal("stat of root failed - ", err)
+	}
+	if root.Qid().Type()&0x80 == 0 {
+		t.Error("root not reported as a directory")
+	}
+}
+
+func TestWalkMissing(t *testing.T) {
+	_, addr := serve(t, NewMemBackend())
+	c := dial(t, addr)
+
+	if _, err := c.walk("/missing"); err == nil {
+		t.Error("walk to a missing file succeeded")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	store := NewMemBackend()
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	if err := c.createFile("/doomed", []byte("bye")); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+
+	if err := c.removeFile("/doomed"); err != nil {
+		t.Fatal("remove failed - ", err)
+	}
+
+	if _, err := store.Stat(context.Background(), "doomed"); err == nil {
+		t.Error("blob still present after remove")
+	}
+
+	if _, err := c.walk("/doomed"); err == nil {
+		t.Error("walk to a removed file succeeded")
+	}
+}
+
+func TestExistingBlobs(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "one", []byte("1"), BlobProps{}, "")
+	store.Put(ctx, "two", []byte("22"), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	names, err := c.list("/")
+	if err != nil {
+		t.Fatal("list failed - ", err)
+	}
+
+	sort.Strings(names)
+	if want := []string{"one", "two"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("listed %q, want %q", names, want)
+	}
+
+	got, err := c.readFile("/two")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if string(got) != "22" {
+		t.Errorf("read %q, want %q", got, "22")
+	}
+}
+
+func TestNestedDirectories(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "a/b/c.txt", []byte("deep"), BlobProps{}, "")
+	store.Put(ctx, "a/d.txt", []byte("shallow"), BlobProps{}, "")
+	store.Put(ctx, "top", []byte("root"), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	lists := []struct {
+		dir  string
+		want []string
+	}{
+		{"/", []string{"a", "top"}},
+		{"/a", []string{"b", "d.txt"}},
+		{"/a/b", []string{"c.txt"}},
+	}
+
+	for _, l := range lists {
+		names, err := c.list(l.dir)
+		if err != nil {
+			t.Fatalf("list of %s failed - %v", l.dir, err)
+		}
+
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, l.want) {
+			t.Errorf("%s listed %q, want %q", l.dir, names, l.want)
+		}
+	}
+
+	stat, err := c.statFile("/a/b")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if stat.Qid().Type()&0x80 == 0 {
+		t.Error("/a/b not reported as a directory")
+	}
+
+	got, err := c.readFile("/a/b/c.txt")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if string(got) != "deep" {
+		t.Errorf("read %q, want %q", got, "deep")
+	}
+
+	if err := c.createFile("/a/b/new.txt", []byte("new")); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+	if got := blobData(t, store, "a/b/new.txt"); string(got) != "new" {
+		t.Errorf("blob holds %q, want %q", got, "new")
+	}
+}
+
+func TestRemoteAdditionsNested(t *testing.T) {
+	store := NewMemBackend()
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	// Appears after the server has populated its tree
+	store.Put(context.Background(), "x/y/z", []byte("late"), BlobProps{}, "")
+
+	got, err := c.readFile("/x/y/z")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if string(got) != "late" {
+		t.Errorf("read %q, want %q", got, "late")
+	}
+}
+
+func TestMkdir(t *testing.T) {
+	store := NewMemBackend()
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	if err := c.mkdir("/staging"); err != nil {
+		t.Fatal("mkdir failed - ", err)
+	}
+	if err := c.mkdir("/staging/inner"); err != nil {
+		t.Fatal("nested mkdir failed - ", err)
+	}
+
+	for _, marker := range []string{"staging/", "staging/inner/"} {
+		if _, err := store.Stat(context.Background(), marker); err != nil {
+			t.Errorf("no marker blob %q - %v", marker, err)
+		}
+	}
+
+	stat, err := c.statFile("/staging/inner")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if stat.Qid().Type()&0x80 == 0 {
+		t.Error("new directory not reported as a directory")
+	}
+
+	// A fresh server over the same store sees the empty directories
+	_, addr = serve(t, store)
+	c = dial(t, addr)
+
+	names, err := c.list("/staging")
+	if err != nil {
+		t.Fatal("list failed - ", err)
+	}
+	if want := []string{"inner"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("listed %q, want %q", names, want)
+	}
+
+	if err := c.createFile("/staging/inner/f", []byte("x")); err != nil {
+		t.Fatal("create in new directory failed - ", err)
+	}
+	if got := blobData(t, store, "staging/inner/f"); string(got) != "x" {
+		t.Errorf("blob holds %q, want %q", got, "x")
+	}
+}
+
+func TestRemoveDirectory(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "full/a", []byte("a"), BlobProps{}, "")
+	store.Put(ctx, "full/sub/b", []byte("b"), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	if err := c.mkdir("/empty"); err != nil {
+		t.Fatal("mkdir failed - ", err)
+	}
+
+	if err := c.removeFile("/empty"); err != nil {
+		t.Fatal("remove of empty directory failed - ", err)
+	}
+	if _, err := store.Stat(ctx, "empty/"); err == nil {
+		t.Error("marker blob still present after remove")
+	}
+	if _, err := c.walk("/empty"); err == nil {
+		t.Error("walk to a removed directory succeeded")
+	}
+
+	err := c.removeFile("/full")
+	if err == nil || err.Error() != ErrNotEmpty.Error() {
+		t.Errorf("remove of non-empty directory gave %v, want %v", err, ErrNotEmpty)
+	}
+	if got := blobData(t, store, "full/sub/b"); string(got) != "b" {
+		t.Errorf("blob holds %q after refused remove, want %q", got, "b")
+	}
+	if _, err := c.walk("/full/sub/b"); err != nil {
+		t.Error("file gone from tree after refused remove - ", err)
+	}
+}
+
+// A backend where someone else writes a blob once a full listing of prefix is taken
+type racingBackend struct {
+	*MemBackend
+	prefix string
+	name   string
+}
+
+func (r *racingBackend) List(ctx context.Context, prefix, delim, marker string) (ListPage, error) {
+	page, err := r.MemBackend.List(ctx, prefix, delim, marker)
+	if prefix == r.prefix && delim == "" && r.name != "" {
+		r.MemBackend.Put(ctx, r.name, []byte("theirs"), BlobProps{}, "")
+		r.name = ""
+	}
+
+	return page, err
+}
+
+func TestRemoveDirectoryRace(t *testing.T) {
+	// Written after the directory was checked empty, a plain remove takes only the marker
+	store := &racingBackend{MemBackend: NewMemBackend(), prefix: "d/", name: "d/theirs"}
+	ctx := context.Background()
+	store.Put(ctx, "d/", nil, BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	if err := c.removeFile("/d"); err != nil {
+		t.Fatal("remove of empty directory failed - ", err)
+	}
+	if _, err := store.Stat(ctx, "d/"); err == nil {
+		t.Error("marker blob still present after remove")
+	}
+	if got := blobData(t, store, "d/theirs"); string(got) != "theirs" {
+		t.Errorf("blob holds %q after remove, want %q", got, "theirs")
+	}
+}
+
+// A backend where someone else writes a blob just before our create of it
+type snipingBackend struct {
+	*MemBackend
+}
+
+func (s *snipingBackend) Put(ctx context.Context, name string, data []byte, props BlobProps, match string) (BlobInfo, error) {
+	if match == IfAbsent {
+		s.MemBackend.Put(ctx, name, []byte("theirs"), BlobProps{}, "")
+	}
+
+	return s.MemBackend.Put(ctx, name, data, props, match)
+}
+
+func TestCreateRace(t *testing.T) {
+	// A create refused for a blob written since the listing shows theirs
+	store := &snipingBackend{MemBackend: NewMemBackend()}
+
+	// Trust the listing so the blob is only found by the create
+	srv, addr := serve(t, store)
+	srv.ttl = time.Hour
+	c := dial(t, addr)
+
+	if err := c.createFile("/f", nil); err == nil {
+		t.Error("create over a blob written since the listing succeeded")
+	}
+	if got := blobData(t, store, "f"); string(got) != "theirs" {
+		t.Errorf("blob holds %q after refused create, want %q", got, "theirs")
+	}
+
+	got, err := c.readFile("/f")
+	if err != nil {
+		t.Fatal("read after refused create failed - ", err)
+	}
+	if string(got) != "theirs" {
+		t.Errorf("read %q after refused create, want %q", got, "theirs")
+	}
+}
+
+func TestRemoveRecursive(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	for i := 0; i < 3*removeBatch; i++ {
+		store.Put(ctx, fmt.Sprintf("logs/%d/%d", i%4, i), []byte("x"), BlobProps{}, "")
+	}
+	store.Put(ctx, "logs/", nil, BlobProps{}, "")
+	store.Put(ctx, "keep", []byte("k"), BlobProps{}, "")
+
+	srv := newServer(t, store)
+	srv.recursive = true
+	c := dial(t, listen(t, srv))
+
+	if err := c.removeFile("/logs"); err != nil {
+		t.Fatal("recursive remove failed - ", err)
+	}
+
+	page, _ := store.List(ctx, "", "", "")
+	blobs := page.Blobs
+	if len(blobs) != 1 || blobs[0].Name != "keep" {
+		t.Errorf("%d blobs left after recursive remove, want only keep", len(blobs))
+	}
+
+	names, err := c.list("/")
+	if err != nil {
+		t.Fatal("list failed - ", err)
+	}
+	if want := []string{"keep"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("listed %q, want %q", names, want)
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "dir/foo", []byte("old"), BlobProps{}, "")
+
+	_, addr := serveOrdered(t, store)
+	c := dial(t, addr)
+
+	// Write aside, then rename over the original
+	if err := c.createFile("/dir/foo.tmp", []byte("new")); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+	if err := c.rename("/dir/foo.tmp", "foo"); err != nil {
+		t.Fatal("rename failed - ", err)
+	}
+
+	if _, err := store.Stat(ctx, "dir/foo.tmp"); err == nil {
+		t.Error("source blob still present after rename")
+	}
+	if got := blobData(t, store, "dir/foo"); string(got) != "new" {
+		t.Errorf("renamed blob holds %q, want %q", got, "new")
+	}
+
+	names, err := c.list("/dir")
+	if err != nil {
+		t.Fatal("list failed - ", err)
+	}
+	if want := []string{"foo"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("listed %q, want %q", names, want)
+	}
+
+	got, err := c.readFile("/dir/foo")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if string(got) != "new" {
+		t.Errorf("read %q, want %q", got, "new")
+	}
+}
+
+func TestRenameDirectory(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "src/", nil, BlobProps{}, "")
+	store.Put(ctx, "src/a", []byte("a"), BlobProps{}, "")
+	store.Put(ctx, "src/sub/b", []byte("b"), BlobProps{}, "")
+	store.Put(ctx, "other/", nil, BlobProps{}, "")
+
+	srv, addr := serveOrdered(t, store)
+	c := dial(t, addr)
+
+	if err := c.rename("/src", "dst"); err != nil {
+		t.Fatal("rename failed - ", err)
+	}
+
+	page, _ := store.List(ctx, "", "", "")
+	blobs := page.Blobs
+	var got []string
+	for _, info := range blobs {
+		got = append(got, info.Name)
+	}
+	want := []string{"dst/", "dst/a", "dst/sub/b", "other/"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("blobs are %q, want %q", got, want)
+	}
+
+	data, err := c.readFile("/dst/sub/b")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if string(data) != "b" {
+		t.Errorf("read %q, want %q", data, "b")
+	}
+
+	// The tree can also move files across directories
+	f, err := srv.File.Search("/dst/a")
+	if err != nil {
+		t.Fatal("search failed - ", err)
+	}
+	if err := f.Rename("/other/a"); err != nil {
+		t.Fatal("move failed - ", err)
+	}
+	if got := blobData(t, store, "other/a"); string(got) != "a" {
+		t.Errorf("moved blob holds %q, want %q", got, "a")
+	}
+	if _, err := c.walk("/other/a"); err != nil {
+		t.Error("moved file not found by walk - ", err)
+	}
+
+	if err := c.rename("/dst", "other"); err == nil {
+		t.Error("rename over an existing directory succeeded")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	store := NewMemBackend()
+	_, addr := serveOrdered(t, store)
+	c := dial(t, addr)
+
+	if err := c.createFile("/t", []byte("0123456789")); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+
+	sizes := []struct {
+		size int64
+		want string
+	}{
+		{4, "0123"},
+		{6, "0123\x00\x00"},
+		{0, ""},
+	}
+
+	for _, s := range sizes {
+		if err := c.truncate("/t", s.size); err != nil {
+			t.Fatalf("truncate to %d failed - %v", s.size, err)
+		}
+
+		if got := blobData(t, store, "t"); string(got) != s.want {
+			t.Errorf("blob holds %q after truncate to %d, want %q", got, s.size, s.want)
+		}
+
+		stat, err := c.statFile("/t")
+		if err != nil {
+			t.Fatal("stat failed - ", err)
+		}
+		if stat.Length() != s.size {
+			t.Errorf("length is %d after truncate, want %d", stat.Length(), s.size)
+		}
+	}
+}
+
+func TestOpenTruncate(t *testing.T) {
+	store := NewMemBackend()
+	store.Put(context.Background(), "f", []byte("stale contents"), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	fid, err := c.walk("/f")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := c.open(fid, styxproto.OWRITE|styxproto.OTRUNC); err != nil {
+		t.Fatal("open failed - ", err)
+	}
+	if err := c.write(fid, 0, []byte("fresh")); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+	c.clunk(fid)
+
+	if got := blobData(t, store, "f"); string(got) != "fresh" {
+		t.Errorf("blob holds %q, want %q", got, "fresh")
+	}
+}
+
+func TestModTime(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	info, _ := store.Put(ctx, "m", []byte("m"), BlobProps{}, "")
+
+	_, addr := serveOrdered(t, store)
+	c := dial(t, addr)
+
+	stat, err := c.statFile("/m")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if want := uint32(info.LastModified.Unix()); stat.Mtime() != want {
+		t.Errorf("mtime is %d, want Last-Modified %d", stat.Mtime(), want)
+	}
+
+	// Well in the past, as `touch -m -d` might ask for
+	const chosen = 1000000000
+	if err := c.touch("/m", chosen); err != nil {
+		t.Fatal("touch failed - ", err)
+	}
+
+	info, err = store.Stat(ctx, "m")
+	if err != nil {
+		t.Fatal("blob stat failed - ", err)
+	}
+	if info.Metadata[mtimeKey] != "1000000000" {
+		t.Errorf("metadata holds %q, want %q", info.Metadata[mtimeKey], "1000000000")
+	}
+
+	// Survives a restart
+	_, addr = serveOrdered(t, store)
+	c = dial(t, addr)
+
+	stat, err = c.statFile("/m")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if stat.Mtime() != chosen {
+		t.Errorf("mtime is %d after restart, want %d", stat.Mtime(), chosen)
+	}
+}
+
+// Backend counting content fetches
+type countingBackend struct {
+	*MemBackend
+	gets   int32
+	puts   int32
+	lists  int32
+	staged int64   // Bytes sent as blocks
+	counts []int64 // Byte counts asked of each Get
+}
+
+func (c *countingBackend) StageBlock(ctx context.Context, name, id string, data []byte) error {
+	atomic.AddInt64(&c.staged, int64(len(data)))
+	return c.MemBackend.StageBlock(ctx, name, id, data)
+}
+
+func (c *countingBackend) Put(ctx context.Context, name string, data []byte, props BlobProps, match string) (BlobInfo, error) {
+	atomic.AddInt32(&c.puts, 1)
+	return c.MemBackend.Put(ctx, name, data, props, match)
+}
+
+func (c *countingBackend) List(ctx context.Context, prefix, delim, marker string) (ListPage, error) {
+	atomic.AddInt32(&c.lists, 1)
+	return c.MemBackend.List(ctx, prefix, delim, marker)
+}
+
+func (c *countingBackend) Get(ctx context.Context, name string, off, count int64) ([]byte, string, error) {
+	atomic.AddInt32(&c.gets, 1)
+
+	c.MemBackend.Lock()
+	c.counts = append(c.counts, count)
+	c.MemBackend.Unlock()
+
+	return c.MemBackend.Get(ctx, name, off, count)
+}
+
+func TestLazyPopulate(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	ctx := context.Background()
+	store.Put(ctx, "a", bytes.Repeat([]byte("a"), 100), BlobProps{}, "")
+	store.Put(ctx, "d/b", bytes.Repeat([]byte("b"), 200), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	for _, f := range []struct {
+		name string
+		size int64
+	}{{"/a", 100}, {"/d/b", 200}} {
+		stat, err := c.statFile(f.name)
+		if err != nil {
+			t.Fatal("stat failed - ", err)
+		}
+		if stat.Length() != f.size {
+			t.Errorf("%s has length %d, want %d", f.name, stat.Length(), f.size)
+		}
+	}
+
+	if n := atomic.LoadInt32(&store.gets); n != 0 {
+		t.Errorf("%d content fetches before any read, want none", n)
+	}
+
+	got, err := c.readFile("/d/b")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if len(got) != 200 {
+		t.Errorf("read %d bytes, want 200", len(got))
+	}
+	if atomic.LoadInt32(&store.gets) == 0 {
+		t.Error("read did not fetch contents")
+	}
+}
+
+func TestRangedReads(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	store.Put(context.Background(), "big", data, BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	got, err := c.readFile("/big")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("ranged reads returned the wrong contents")
+	}
+
+	// Without read-ahead every fetch is bounded by the size of one read
+	window := c.msize - styxproto.IOHeaderSize
+	for _, n := range store.counts {
+		if n < 0 || n > window {
+			t.Errorf("fetched %d bytes, want at most %d", n, window)
+		}
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	store.Put(context.Background(), "big", data, BlobProps{}, "")
+
+	srv := newServer(t, store)
+	srv.readAhead = 20000
+	c := dial(t, listen(t, srv))
+
+	got, err := c.readFile("/big")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read-ahead returned the wrong contents")
+	}
+
+	// 50000 bytes in 20000 byte windows
+	if n := atomic.LoadInt32(&store.gets); n != 3 {
+		t.Errorf("%d fetches with read-ahead, want 3", n)
+	}
+}
+
+// Create full and write data to it in many messages, leaving the fid open
+func writeOpen(t *testing.T, c *client, full string, data []byte) uint32 {
+	t.Helper()
+
+	dir, name := splitPath(full)
+	fid, err := c.walk(dir)
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+
+	if err := c.create(fid, name, 0666, styxproto.ORDWR); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+
+	if err := c.write(fid, 0, data); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+
+	return fid
+}
+
+func TestWriteBack(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	fid := writeOpen(t, c, "/f", data)
+
+	// Only the create has reached the remote
+	if n := atomic.LoadInt32(&store.puts); n != 1 {
+		t.Errorf("%d uploads before clunk, want 1", n)
+	}
+
+	stat, err := c.stat(fid)
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if stat.Length() != int64(len(data)) {
+		t.Errorf("buffered file has length %d, want %d", stat.Length(), len(data))
+	}
+
+	if err := c.clunk(fid); err != nil {
+		t.Fatal("clunk failed - ", err)
+	}
+
+	if n := atomic.LoadInt32(&store.puts); n != 2 {
+		t.Errorf("%d uploads after clunk, want 2", n)
+	}
+	if !bytes.Equal(blobData(t, store, "f"), data) {
+		t.Error("clunk did not commit the written contents")
+	}
+}
+
+func TestWriteBackSync(t *testing.T) {
+	store := NewMemBackend()
+	_, addr := serveOrdered(t, store)
+	c := dial(t, addr)
+
+	fid := writeOpen(t, c, "/f", []byte("hello"))
+	defer c.clunk(fid)
+
+	// A wstat changing nothing is an fsync
+	if err := c.wstat(fid, nullStat(t, "")); err != nil {
+		t.Fatal("sync failed - ", err)
+	}
+
+	if got := blobData(t, store, "f"); string(got) != "hello" {
+		t.Errorf("blob holds %q after sync, want %q", got, "hello")
+	}
+}
+
+func TestWriteBackThreshold(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	srv := newServer(t, store)
+	srv.dirtyMax = 20000
+	c := dial(t, listen(t, srv))
+
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	fid := writeOpen(t, c, "/f", data)
+	defer c.clunk(fid)
+
+	// The create, then an upload for each 20000 bytes buffered
+	if n := atomic.LoadInt32(&store.puts); n != 3 {
+		t.Errorf("%d uploads with a dirty limit, want 3", n)
+	}
+}
+
+func TestWriteBackIdle(t *testing.T) {
+	store := NewMemBackend()
+	srv := newServer(t, store)
+	srv.idle = 10 * time.Millisecond
+	c := dial(t, listen(t, srv))
+
+	fid := writeOpen(t, c, "/f", []byte("hello"))
+	defer c.clunk(fid)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for string(blobData(t, store, "f")) != "hello" {
+		if time.Now().After(deadline) {
+			t.Fatal("idle writes were never committed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBlockWrites(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	srv := newServer(t, store)
+	srv.blockSize = 1000
+	c := dial(t, listen(t, srv))
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := c.clunk(writeOpen(t, c, "/log", data)); err != nil {
+		t.Fatal("clunk failed - ", err)
+	}
+
+	blocks, err := store.Blocks(context.Background(), "log")
+	if err != nil {
+		t.Fatal("could not list blocks - ", err)
+	}
+	if len(blocks) != 10 {
+		t.Errorf("blob has %d blocks, want 10", len(blocks))
+	}
+
+	// Appending stages only the new bytes
+	atomic.StoreInt64(&store.staged, 0)
+	tail := []byte("appended")
+	if err := c.writeFile("/log", int64(len(data)), tail); err != nil {
+		t.Fatal("append failed - ", err)
+	}
+
+	if n := atomic.LoadInt64(&store.staged); n != int64(len(tail)) {
+		t.Errorf("staged %d bytes to append, want %d", n, len(tail))
+	}
+
+	want := append(data, tail...)
+	if !bytes.Equal(blobData(t, store, "log"), want) {
+		t.Error("blob contents wrong after append")
+	}
+
+	got, err := c.readFile("/log")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("read contents wrong after append")
+	}
+}
+
+func TestBlocksKeptByTouchAndRename(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	srv := newServer(t, store)
+	srv.blockSize = 1000
+	c := dial(t, listenOrdered(t, srv))
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := c.clunk(writeOpen(t, c, "/log", data)); err != nil {
+		t.Fatal("clunk failed - ", err)
+	}
+
+	// Neither changes the contents, so neither changes the block list
+	if err := c.touch("/log", 1000000000); err != nil {
+		t.Fatal("touch failed - ", err)
+	}
+	if err := c.rename("/log", "moved"); err != nil {
+		t.Fatal("rename failed - ", err)
+	}
+
+	atomic.StoreInt64(&store.staged, 0)
+	if err := c.writeFile("/moved", 0, []byte("x")); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+
+	if n := atomic.LoadInt64(&store.staged); n != 1000 {
+		t.Errorf("staged %d bytes to patch, want 1000", n)
+	}
+
+	want := append([]byte("x"), data[1:]...)
+	if !bytes.Equal(blobData(t, store, "moved"), want) {
+		t.Error("blob contents wrong after patch")
+	}
+}
+
+func TestBlockWritesForeignIDs(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+
+	// Another writer committed block IDs unlike ours
+	store.StageBlock(ctx, "f", "AAAA", []byte("hello "))
+	store.StageBlock(ctx, "f", "AAAB", []byte("world"))
+	if _, err := store.CommitBlocks(ctx, "f", []string{"AAAA", "AAAB"}, BlobProps{}, ""); err != nil {
+		t.Fatal("could not commit blocks - ", err)
+	}
+
+	srv := newServer(t, store)
+	srv.blockSize = 4
+	c := dial(t, listen(t, srv))
+
+	if err := c.writeFile("/f", 11, []byte("!")); err != nil {
+		t.Fatal("append failed - ", err)
+	}
+
+	if got := blobData(t, store, "f"); string(got) != "hello world!" {
+		t.Errorf("blob holds %q, want %q", got, "hello world!")
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		off  int64
+		data string
+		want string
+	}{
+		{"overwrite", 2, "ab", "01ab456789"},
+		{"extend", 8, "xyz", "01234567xyz"},
+		{"append", 10, "xyz", "0123456789xyz"},
+		{"gap", 12, "z", "0123456789\x00\x00z"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewMemBackend()
+			store.Put(context.Background(), "f", []byte("0123456789"), BlobProps{}, "")
+
+			_, addr := serve(t, store)
+			c := dial(t, addr)
+
+			if err := c.writeFile("/f", tc.off, []byte(tc.data)); err != nil {
+				t.Fatal("write failed - ", err)
+			}
+
+			if got := blobData(t, store, "f"); string(got) != tc.want {
+				t.Errorf("blob holds %q, want %q", got, tc.want)
+			}
+
+			got, err := c.readFile("/f")
+			if err != nil {
+				t.Fatal("read failed - ", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("read %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBlockPatch(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	srv := newServer(t, store)
+	srv.blockSize = 1000
+	c := dial(t, listen(t, srv))
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := c.clunk(writeOpen(t, c, "/data", data)); err != nil {
+		t.Fatal("clunk failed - ", err)
+	}
+
+	// Patching the middle restages the one block it falls in
+	atomic.StoreInt64(&store.staged, 0)
+	if err := c.writeFile("/data", 5500, []byte("patched")); err != nil {
+		t.Fatal("patch failed - ", err)
+	}
+
+	if n := atomic.LoadInt64(&store.staged); n != 1000 {
+		t.Errorf("staged %d bytes to patch, want 1000", n)
+	}
+
+	copy(data[5500:], "patched")
+	if !bytes.Equal(blobData(t, store, "data"), data) {
+		t.Error("blob contents wrong after patch")
+	}
+}
+
+func TestPropsKept(t *testing.T) {
+	// Uploaded whole or block by block, a rewrite keeps the content type and metadata
+	for _, blockSize := range []int64{0, 1000} {
+		store := NewMemBackend()
+		ctx := context.Background()
+		props := BlobProps{
+			ContentType: "text/plain",
+			Metadata:    map[string]string{"owner": "ops", mtimeKey: "1000"},
+		}
+		store.Put(ctx, "f", bytes.Repeat([]byte("x"), 3000), props, "")
+
+		srv := newServer(t, store)
+		srv.blockSize = blockSize
+		c := dial(t, listen(t, srv))
+
+		if err := c.writeFile("/f", 1500, []byte("changed")); err != nil {
+			t.Fatal("write failed - ", err)
+		}
+
+		info, err := store.Stat(ctx, "f")
+		if err != nil {
+			t.Fatal("stat failed - ", err)
+		}
+		if info.ContentType != "text/plain" {
+			t.Errorf("block size %d: content type %q after write, want %q", blockSize, info.ContentType, "text/plain")
+		}
+		if info.Metadata["owner"] != "ops" {
+			t.Errorf("block size %d: metadata %v after write lost owner", blockSize, info.Metadata)
+		}
+		if _, ok := info.Metadata[mtimeKey]; ok {
+			t.Errorf("block size %d: chosen mtime kept after write", blockSize)
+		}
+	}
+}
+
+func TestAppendBlob(t *testing.T) {
+	store := NewMemBackend()
+	srv := newServer(t, store)
+	srv.typeRules = map[string]BlobType{".log": AppendBlob}
+	c := dial(t, listen(t, srv))
+
+	fid := writeOpen(t, c, "/audit.log", []byte("one "))
+	if err := c.write(fid, 4, []byte("two")); err != nil {
+		t.Fatal("append failed - ", err)
+	}
+
+	// Writes into the middle go to the end
+	if err := c.write(fid, 0, []byte("!")); err != nil {
+		t.Fatal("append at offset 0 failed - ", err)
+	}
+	c.clunk(fid)
+
+	info, err := store.Stat(context.Background(), "audit.log")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if info.Type != AppendBlob {
+		t.Errorf("created a %s blob, want append", info.Type)
+	}
+
+	got, err := c.readFile("/audit.log")
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	if string(got) != "one two!" {
+		t.Errorf("read %q, want %q", got, "one two!")
+	}
+}
+
+func TestPageBlob(t *testing.T) {
+	store := NewMemBackend()
+	srv := newServer(t, store)
+	srv.blobType = PageBlob
+	c := dial(t, listen(t, srv))
+
+	data := bytes.Repeat([]byte("p"), 2*pageSize)
+	fid := writeOpen(t, c, "/disk.vhd", data)
+
+	// Zeroed pages are cleared
+	zero := make([]byte, pageSize)
+	if err := c.write(fid, pageSize, zero); err != nil {
+		t.Fatal("clearing write failed - ", err)
+	}
+
+	c.clunk(fid)
+
+	info, err := store.Stat(context.Background(), "disk.vhd")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if info.Type != PageBlob {
+		t.Errorf("created a %s blob, want page", info.Type)
+	}
+
+	want := append(data[:pageSize:pageSize], zero...)
+	if !bytes.Equal(blobData(t, store, "disk.vhd"), want) {
+		t.Error("page blob contents wrong")
+	}
+}
+
+func TestBlobTypeStat(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "block", []byte("b"), BlobProps{}, "")
+	store.CreateAppend(ctx, "append", "")
+	store.CreatePages(ctx, "page", pageSize, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	for _, typ := range []BlobType{BlockBlob, AppendBlob, PageBlob} {
+		stat, err := c.statFile("/" + string(typ))
+		if err != nil {
+			t.Fatal("stat failed - ", err)
+		}
+
+		if string(stat.Gid()) != string(typ) {
+			t.Errorf("%s blob has group %q", typ, stat.Gid())
+		}
+
+		isAppend := stat.Mode()&styxproto.DMAPPEND != 0
+		if isAppend != (typ == AppendBlob) {
+			t.Errorf("%s blob has append mode %v", typ, isAppend)
+		}
+	}
+}
+
+func TestNewBlobType(t *testing.T) {
+	rules, err := parseTypeRules(".vhd=page,.log=append,.big.log=block")
+	if err != nil {
+		t.Fatal("could not parse rules - ", err)
+	}
+
+	srv := &Server{typeRules: rules}
+	for _, tc := range []struct {
+		name string
+		mode os.FileMode
+		want BlobType
+	}{
+		{"a.txt", 0666, BlockBlob},
+		{"a.vhd", 0666, PageBlob},
+		{"a.log", 0666, AppendBlob},
+		{"a.big.log", 0666, BlockBlob},
+		{"a.txt", os.ModeAppend | 0666, AppendBlob},
+	} {
+		if got := srv.newBlobType(tc.name, tc.mode); got != tc.want {
+			t.Errorf("%s with mode %v is a %s blob, want %s", tc.name, tc.mode, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"vhd", ".vhd=disk", "=page"} {
+		if _, err := parseTypeRules(bad); err == nil {
+			t.Errorf("rules %q parsed", bad)
+		}
+	}
+}
+
+func TestPagePatch(t *testing.T) {
+	store := NewMemBackend()
+	store.CreatePages(context.Background(), "disk", pageSize, "")
+
+	_, addr := serveOrdered(t, store)
+	c := dial(t, addr)
+
+	// Partial pages are read, patched and written back, growing the blob by whole pages
+	if err := c.writeFile("/disk", 500, []byte("straddles a page")); err != nil {
+		t.Fatal("unaligned write failed - ", err)
+	}
+
+	want := make([]byte, 2*pageSize)
+	copy(want[500:], "straddles a page")
+	if !bytes.Equal(blobData(t, store, "disk"), want) {
+		t.Error("page blob contents wrong after unaligned write")
+	}
+
+	if err := c.truncate("/disk", 100); err == nil {
+		t.Error("page blob resized to a partial page")
+	}
+
+	if err := c.truncate("/disk", pageSize); err != nil {
+		t.Fatal("page blob resize failed - ", err)
+	}
+	if n := len(blobData(t, store, "disk")); n != pageSize {
+		t.Errorf("page blob is %d bytes after resize, want %d", n, pageSize)
+	}
+}
+
+func TestBlobTypeKept(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.CreateAppend(ctx, "audit", "")
+	store.Append(ctx, "audit", []byte("entry\n"))
+
+	srv, addr := serveOrdered(t, store)
+	c := dial(t, addr)
+
+	// Writes to DMAPPEND files land at the end whatever the offset
+	if err := c.writeFile("/audit", 0, []byte("over\n")); err != nil {
+		t.Error("write at the start of an append blob failed - ", err)
+	}
+
+	if err := c.truncate("/audit", 0); err == nil || err.Error() != ErrAppendTruncate.Error() {
+		t.Errorf("truncate of an append blob gave %v, want %v", err, ErrAppendTruncate)
+	}
+
+	fid, err := c.walk("/audit")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := c.open(fid, styxproto.OWRITE|styxproto.OTRUNC); err == nil {
+		t.Error("truncating open of an append blob succeeded")
+	}
+	c.clunk(fid)
+
+	// Creating over it as a block blob must not replace it
+	dir, err := c.walk("/")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	defer c.clunk(dir)
+	if err := c.create(dir, "audit", 0666, styxproto.ORDWR); err == nil {
+		t.Error("create replaced an append blob")
+	}
+
+	// Even where the tree has not seen it
+	f := &File{parent: srv.File, srv: srv, name: "audit"}
+	f.Blob = NewBlob(f, store)
+	if err := f.Blob.Create(ctx, BlockBlob); err != os.ErrExist {
+		t.Errorf("create over an append blob gave %v, want %v", err, os.ErrExist)
+	}
+
+	if err := c.writeFile("/audit", 6, []byte("more\n")); err != nil {
+		t.Fatal("append failed - ", err)
+	}
+
+	info, err := store.Stat(ctx, "audit")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if info.Type != AppendBlob {
+		t.Errorf("blob became a %s blob", info.Type)
+	}
+	if got := blobData(t, store, "audit"); string(got) != "entry\nover\nmore\n" {
+		t.Errorf("blob holds %q", got)
+	}
+}
+
+func TestWriteConflict(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "f", []byte("ours"), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	fid, err := c.walk("/f")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := c.open(fid, styxproto.OWRITE); err != nil {
+		t.Fatal("open failed - ", err)
+	}
+	if err := c.write(fid, 0, []byte("OURS")); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+
+	// Someone else writes before our writes are committed
+	store.Put(ctx, "f", []byte("theirs"), BlobProps{}, "")
+
+	err = c.clunk(fid)
+	if err == nil || !strings.Contains(err.Error(), ErrConflict.Error()) {
+		t.Errorf("commit over a remote change gave %v, want %v", err, ErrConflict)
+	}
+
+	if got := blobData(t, store, "f"); string(got) != "theirs" {
+		t.Errorf("blob holds %q, their write was lost", got)
+	}
+
+	// Reported once, the rejected writes are gone and reads see their contents
+	got, err := c.readFile("/f")
+	if err != nil {
+		t.Fatal("read after a conflict failed - ", err)
+	}
+	if string(got) != "theirs" {
+		t.Errorf("read %q after a conflict, want %q", got, "theirs")
+	}
+}
+
+func TestIdleConflict(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "f", []byte("0123456789"), BlobProps{}, "")
+
+	srv := newServer(t, store)
+	srv.idle = 50 * time.Millisecond
+	c := dial(t, listen(t, srv))
+
+	fid, err := c.walk("/f")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := c.open(fid, styxproto.OWRITE); err != nil {
+		t.Fatal("open failed - ", err)
+	}
+	if err := c.write(fid, 0, []byte("AA")); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+	store.Put(ctx, "f", []byte("theirs-data"), BlobProps{}, "")
+
+	f, err := srv.File.Search("/f")
+	if err != nil {
+		t.Fatal("search failed - ", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for f.pending() {
+		if time.Now().After(deadline) {
+			t.Fatal("idle commit never ran")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The idle commit dropped our writes, later ones would land on their contents
+	err = c.write(fid, 8, []byte("BB"))
+	if err == nil || !strings.Contains(err.Error(), ErrConflict.Error()) {
+		t.Errorf("write after an idle conflict gave %v, want %v", err, ErrConflict)
+	}
+
+	// The clunk that follows reports it
+	err = c.clunk(fid)
+	if err == nil || !strings.Contains(err.Error(), ErrConflict.Error()) {
+		t.Errorf("clunk after an idle conflict gave %v, want %v", err, ErrConflict)
+	}
+	if got := blobData(t, store, "f"); string(got) != "theirs-data" {
+		t.Errorf("blob holds %q after an idle conflict, want %q", got, "theirs-data")
+	}
+
+	// Once clunked the file is written to afresh
+	if err := c.writeFile("/f", 0, []byte("OURS")); err != nil {
+		t.Fatal("write after the clunk failed - ", err)
+	}
+	if got := blobData(t, store, "f"); string(got) != "OURSrs-data" {
+		t.Errorf("blob holds %q, want %q", got, "OURSrs-data")
+	}
+}
+
+func TestRemoveConflict(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "f", []byte("old"), BlobProps{}, "")
+
+	// Trust the listing so the change is only found by the backend
+	srv, addr := serve(t, store)
+	srv.ttl = time.Hour
+	c := dial(t, addr)
+
+	if _, err := c.statFile("/f"); err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+
+	store.Put(ctx, "f", []byte("new"), BlobProps{}, "")
+
+	err := c.removeFile("/f")
+	if err == nil || err.Error() != ErrConflict.Error() {
+		t.Errorf("remove over a remote change gave %v, want %v", err, ErrConflict)
+	}
+
+	if got := blobData(t, store, "f"); string(got) != "new" {
+		t.Errorf("blob holds %q after failed remove", got)
+	}
+}
+
+func TestRemoveConflictKeepsWrites(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "f", []byte("old"), BlobProps{}, "")
+
+	srv, addr := serve(t, store)
+	srv.ttl = time.Hour
+	c := dial(t, addr)
+
+	fid, err := c.walk("/f")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := c.open(fid, styxproto.ORDWR); err != nil {
+		t.Fatal("open failed - ", err)
+	}
+	if err := c.write(fid, 0, []byte("ours")); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+
+	store.Put(ctx, "f", []byte("new"), BlobProps{}, "")
+	if err := c.removeFile("/f"); err == nil || err.Error() != ErrConflict.Error() {
+		t.Errorf("remove over a remote change gave %v, want %v", err, ErrConflict)
+	}
+
+	// The writes survive the failed remove, still held for upload
+	f, err := srv.File.Search("/f")
+	if err != nil || !f.pending() {
+		t.Fatal("failed remove dropped unsent writes")
+	}
+	if got, err := c.read(fid, 0); err != nil || string(got) != "ours" {
+		t.Errorf("read %q, %v after failed remove, want %q", got, err, "ours")
+	}
+}
+
+func TestAppendShared(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.CreateAppend(ctx, "log", "")
+
+	// Trust the listing so the change is only found by the backend
+	srv, addr := serve(t, store)
+	srv.ttl = time.Hour
+	c := dial(t, addr)
+
+	if err := c.writeFile("/log", 0, []byte("a\n")); err != nil {
+		t.Fatal("append failed - ", err)
+	}
+
+	// Another writer appends behind our back, ours still go after theirs
+	store.Append(ctx, "log", []byte("b\n"))
+
+	if err := c.writeFile("/log", 2, []byte("c\n")); err != nil {
+		t.Fatal("append after another writer's failed - ", err)
+	}
+	if got := blobData(t, store, "log"); string(got) != "a\nb\nc\n" {
+		t.Errorf("blob holds %q, want %q", got, "a\nb\nc\n")
+	}
+
+	stat, err := c.statFile("/log")
+	if err != nil || stat.Length() != 6 {
+		t.Errorf("stat gave length %d, %v after shared appends, want 6", stat.Length(), err)
+	}
+}
+
+func TestOwnChangesNoConflict(t *testing.T) {
+	store := NewMemBackend()
+	_, addr := serveOrdered(t, store)
+	c := dial(t, addr)
+
+	if err := c.createFile("/f", []byte("one")); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+
+	// Our own metadata changes and renames must not look like someone else's
+	if err := c.touch("/f", 1000); err != nil {
+		t.Fatal("touch failed - ", err)
+	}
+	if err := c.writeFile("/f", 3, []byte("two")); err != nil {
+		t.Fatal("write after touch failed - ", err)
+	}
+
+	if err := c.rename("/f", "g"); err != nil {
+		t.Fatal("rename failed - ", err)
+	}
+	if err := c.writeFile("/g", 6, []byte("three")); err != nil {
+		t.Fatal("write after rename failed - ", err)
+	}
+
+	if got := blobData(t, store, "g"); string(got) != "onetwothree" {
+		t.Errorf("blob holds %q", got)
+	}
+
+	if err := c.removeFile("/g"); err != nil {
+		t.Fatal("remove failed - ", err)
+	}
+}
+
+func TestListingTTL(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	ctx := context.Background()
+	store.Put(ctx, "a", []byte("old"), BlobProps{}, "")
+
+	srv, addr := serve(t, store)
+	srv.ttl = 200 * time.Millisecond
+	c := dial(t, addr)
+
+	atomic.StoreInt32(&store.lists, 0)
+	for i := 0; i < 3; i++ {
+		if _, err := c.statFile("/a"); err != nil {
+			t.Fatal("stat failed - ", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&store.lists); n != 0 {
+		t.Errorf("%d listings within the TTL, want none", n)
+	}
+
+	// Directory reads always list, a page at a time
+	if _, err := c.list("/"); err != nil {
+		t.Fatal("list failed - ", err)
+	}
+	if n := atomic.LoadInt32(&store.lists); n != 1 {
+		t.Errorf("%d listings to read a directory, want 1", n)
+	}
+
+	store.Put(ctx, "a", []byte("changed"), BlobProps{}, "")
+	time.Sleep(300 * time.Millisecond)
+
+	stat, err := c.statFile("/a")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if stat.Length() != 7 {
+		t.Errorf("length %d after the TTL, want 7", stat.Length())
+	}
+
+	if got, err := c.readFile("/a"); err != nil || string(got) != "changed" {
+		t.Errorf("read %q, %v after the TTL, want %q", got, err, "changed")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	store := NewMemBackend()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newServer(t, store)
+	srv.ctx = ctx
+	srv.ttl = 10 * time.Millisecond
+	addr := listen(t, srv)
+	c := dial(t, addr)
+
+	if err := c.createFile("/f", []byte("ours")); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+
+	// Contents we wrote are held, a change must drop them
+	store.Put(context.Background(), "f", []byte("theirs!"), BlobProps{}, "")
+	go srv.Refresh(5 * time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		f, _ := srv.File.Search("/f")
+		f.Blob.lock()
+		size, loaded := f.Blob.size, f.Blob.loaded
+		f.Blob.unlock()
+
+		if size == 7 && !loaded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("refresh left size %d, loaded %v", size, loaded)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got, err := c.readFile("/f"); err != nil || string(got) != "theirs!" {
+		t.Errorf("read %q, %v after refresh, want %q", got, err, "theirs!")
+	}
+}
+
+func TestSyncKeepsDirty(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "f", []byte("ours"), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	fid, err := c.walk("/f")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := c.open(fid, styxproto.OWRITE); err != nil {
+		t.Fatal("open failed - ", err)
+	}
+	if err := c.write(fid, 4, []byte(" too")); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+
+	// A listing after the remote change must not throw away our writes
+	store.Put(ctx, "f", []byte("theirs"), BlobProps{}, "")
+	if _, err := c.list("/"); err != nil {
+		t.Fatal("list failed - ", err)
+	}
+
+	stat, err := c.statFile("/f")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if stat.Length() != 8 {
+		t.Errorf("length %d with writes pending, want 8", stat.Length())
+	}
+
+	err = c.clunk(fid)
+	if err == nil || !strings.Contains(err.Error(), ErrConflict.Error()) {
+		t.Errorf("commit over a remote change gave %v, want %v", err, ErrConflict)
+	}
+}
+
+func TestRemoteDelete(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "a", []byte("a"), BlobProps{}, "")
+	store.Put(ctx, "keep", []byte("keep"), BlobProps{}, "")
+	store.Put(ctx, "d/b", []byte("b"), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	// A fid held open across the deletion
+	fid, err := c.walk("/a")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := c.open(fid, styxproto.OREAD); err != nil {
+		t.Fatal("open failed - ", err)
+	}
+
+	store.Delete(ctx, "a", "")
+	store.Delete(ctx, "d/b", "")
+
+	names, err := c.list("/")
+	if err != nil {
+		t.Fatal("list failed - ", err)
+	}
+	if len(names) != 1 || names[0] != "keep" {
+		t.Errorf("listed %q after remote deletes, want [keep]", names)
+	}
+
+	for _, name := range []string{"/a", "/d", "/d/b"} {
+		if _, err := c.statFile(name); err == nil {
+			t.Errorf("stat of remotely deleted %s succeeded", name)
+		}
+	}
+
+	c.enc.Tread(1, fid, 0, 100)
+	if _, err := c.reply(); err == nil || err.Error() != os.ErrNotExist.Error() {
+		t.Errorf("read of a remotely deleted file gave %v, want %v", err, os.ErrNotExist)
+	}
+	c.clunk(fid)
+}
+
+func TestRemoteDeleteKeepsDirty(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "f", []byte("ours"), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	fid, err := c.walk("/f")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := c.open(fid, styxproto.OWRITE); err != nil {
+		t.Fatal("open failed - ", err)
+	}
+	if err := c.write(fid, 0, []byte("OURS")); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+
+	store.Delete(ctx, "f", "")
+
+	if _, err := c.statFile("/f"); err != nil {
+		t.Errorf("file with pending writes left the tree - %v", err)
+	}
+
+	err = c.clunk(fid)
+	if err == nil || !strings.Contains(err.Error(), ErrConflict.Error()) {
+		t.Errorf("commit over a remote delete gave %v, want %v", err, ErrConflict)
+	}
+
+	// Its writes dropped, the next listing lets it go
+	names, err := c.list("/")
+	if err != nil {
+		t.Fatal("list failed - ", err)
+	}
+	if len(names) != 0 {
+		t.Errorf("listed %q after a failed upload, want none", names)
+	}
+}
+
+func TestRemoteReplace(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	store.Put(ctx, "x", []byte("file"), BlobProps{}, "")
+	store.Put(ctx, "y", []byte("old"), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	// Hold the contents of y locally
+	if err := c.writeFile("/y", 0, []byte("OLD")); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+
+	// x becomes a directory, y gets new contents under the same name
+	store.Delete(ctx, "x", "")
+	store.Put(ctx, "x/z", []byte("z"), BlobProps{}, "")
+	store.Put(ctx, "y", []byte("replaced"), BlobProps{}, "")
+
+	stat, err := c.statFile("/x")
+	if err != nil {
+		t.Fatal("stat failed - ", err)
+	}
+	if stat.Mode()&styxproto.DMDIR == 0 {
+		t.Errorf("/x is not a directory after being replaced by one")
+	}
+
+	if got, err := c.readFile("/x/z"); err != nil || string(got) != "z" {
+		t.Errorf("read %q, %v from the new directory, want %q", got, err, "z")
+	}
+
+	if got, err := c.readFile("/y"); err != nil || string(got) != "replaced" {
+		t.Errorf("read %q, %v from a replaced blob, want %q", got, err, "replaced")
+	}
+}
+
+// An EventSource fed by the test
+type chanSource chan []Event
+
+func (c chanSource) Next(ctx context.Context) ([]Event, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case events := <-c:
+		return events, nil
+	}
+}
+
+// Wait until fn, looking into the tree, holds
+func waitTree(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if fn() {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for ", what)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store.Put(ctx, "old", []byte("old"), BlobProps{}, "")
+	store.Put(ctx, "same", []byte("before"), BlobProps{}, "")
+
+	srv := newServer(t, store)
+	srv.ctx = ctx
+	srv.ttl = time.Hour
+	addr := listen(t, srv)
+	c := dial(t, addr)
+
+	src := make(chanSource)
+	go srv.Watch(src)
+
+	atomic.StoreInt32(&store.lists, 0)
+
+	store.Put(ctx, "d/e/new", []byte("new"), BlobProps{}, "")
+	store.Delete(ctx, "old", "")
+	store.Put(ctx, "same", []byte("after!"), BlobProps{}, "")
+	src <- []Event{{Name: "d/e/new"}, {Name: "old", Deleted: true}, {Name: "same"}}
+
+	waitTree(t, "events to apply", func() bool {
+		_, err := srv.File.Search("/old")
+		return err != nil
+	})
+
+	if got, err := c.readFile("/d/e/new"); err != nil || string(got) != "new" {
+		t.Errorf("read %q, %v from a created blob, want %q", got, err, "new")
+	}
+	if _, err := c.statFile("/old"); err == nil {
+		t.Errorf("stat of a deleted blob succeeded")
+	}
+	if got, err := c.readFile("/same"); err != nil || string(got) != "after!" {
+		t.Errorf("read %q, %v from a replaced blob, want %q", got, err, "after!")
+	}
+
+	// A late delete for a blob that exists again must not remove it
+	store.Put(ctx, "old", []byte("back"), BlobProps{}, "")
+	src <- []Event{{Name: "old"}}
+	src <- []Event{{Name: "old", Deleted: true}}
+	src <- []Event{{Name: "d/e/new", Deleted: true}}
+	store.Delete(ctx, "d/e/new", "")
+
+	waitTree(t, "late events to apply", func() bool {
+		_, err := srv.File.Search("/d/e/new")
+		return err != nil
+	})
+
+	if got, err := c.readFile("/old"); err != nil || string(got) != "back" {
+		t.Errorf("read %q, %v from a recreated blob, want %q", got, err, "back")
+	}
+
+	if n := atomic.LoadInt32(&store.lists); n != 0 {
+		t.Errorf("%d listings while applying events, want none", n)
+	}
+}
+
+// An EventSource failing partway through a batch, after fetching some events
+type failingSource struct {
+	events []Event
+	done   bool
+}
+
+func (s *failingSource) Next(ctx context.Context) ([]Event, error) {
+	if s.done {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	s.done = true
+	return s.events, errors.New("connection reset")
+}
+
+func TestWatchFailure(t *testing.T) {
+	store := NewMemBackend()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store.Put(ctx, "old", []byte("old"), BlobProps{}, "")
+
+	srv := newServer(t, store)
+	srv.ctx = ctx
+	srv.ttl = time.Hour
+	c := dial(t, listen(t, srv))
+
+	if _, err := c.list("/"); err != nil {
+		t.Fatal("list failed - ", err)
+	}
+
+	store.Put(ctx, "new", []byte("new"), BlobProps{}, "")
+	go srv.Watch(&failingSource{events: []Event{{Name: "new"}}})
+
+	waitTree(t, "events fetched before the failure to apply", func() bool {
+		_, err := srv.File.Search("/new")
+		return err == nil
+	})
+}
+
+func TestGridEvent(t *testing.T) {
+	for _, test := range []struct {
+		typ, subject string
+		ok           bool
+		want         Event
+	}{
+		{blobCreated, "/blobServices/default/containers/c/blobs/a/b", true, Event{Name: "a/b"}},
+		{blobDeleted, "/blobServices/default/containers/c/blobs/a", true, Event{Name: "a", Deleted: true}},
+		{blobCreated, "/blobServices/default/containers/other/blobs/a", false, Event{}},
+		{blobCreated, "/blobServices/default/containers/c/blobs/", false, Event{}},
+		{"Microsoft.Storage.BlobTierChanged", "/blobServices/default/containers/c/blobs/a", false, Event{}},
+	} {
+		got, ok := parseGridEvent(gridEvent{Type: test.typ, Subject: test.subject}, "c")
+		if ok != test.ok || got != test.want {
+			t.Errorf("%s %s gave %+v, %v, want %+v, %v", test.typ, test.subject, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789abcdef"), cacheChunk*5/2/16)
+	store.Put(ctx, "big", data, BlobProps{}, "")
+
+	dir := t.TempDir()
+
+	// Each server stands for a run of abfs over the same cache directory
+	run := func() *client {
+		srv := newServer(t, store)
+		cache, err := OpenCache(dir, 0, 0)
+		if err != nil {
+			t.Fatal("could not open cache - ", err)
+		}
+		srv.cache = cache
+
+		return dial(t, listen(t, srv))
+	}
+
+	c := run()
+	got, err := c.readFile("/big")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("first read gave %d bytes, %v", len(got), err)
+	}
+	if n := atomic.LoadInt32(&store.gets); n != 3 {
+		t.Errorf("%d fetches filling the cache, want 3", n)
+	}
+
+	// A restart reads everything from disk
+	atomic.StoreInt32(&store.gets, 0)
+	c = run()
+	got, err = c.readFile("/big")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read after restart gave %d bytes, %v", len(got), err)
+	}
+	if n := atomic.LoadInt32(&store.gets); n != 0 {
+		t.Errorf("%d fetches after restart, want none", n)
+	}
+
+	// A changed blob misses
+	store.Put(ctx, "big", []byte("small now"), BlobProps{}, "")
+	if got, err := c.readFile("/big"); err != nil || string(got) != "small now" {
+		t.Errorf("read %q, %v after a remote change, want %q", got, err, "small now")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := OpenCache(dir, 30, 0)
+	if err != nil {
+		t.Fatal("could not open cache - ", err)
+	}
+
+	chunk := bytes.Repeat([]byte("x"), 10)
+	cache.Put("a", "1", 0, chunk)
+	cache.Put("b", "1", 0, chunk)
+	cache.Put("c", "1", 0, chunk)
+
+	// a becomes the most recently used, b the least
+	if _, ok := cache.Get("a", "1", 0); !ok {
+		t.Fatal("a missing from the cache")
+	}
+
+	cache.Put("d", "1", 0, chunk)
+
+	for _, test := range []struct {
+		name string
+		held bool
+	}{{"a", true}, {"b", false}, {"c", true}, {"d", true}} {
+		if _, ok := cache.Get(test.name, "1", 0); ok != test.held {
+			t.Errorf("%s held is %v, want %v", test.name, ok, test.held)
+		}
+	}
+
+	if size := cache.Size(); size != 30 {
+		t.Errorf("cache holds %d bytes, want 30", size)
+	}
+
+	// Order of use survives reopening, c is now the least recently used
+	cache.Get("c", "1", 0)
+	time.Sleep(10 * time.Millisecond)
+	cache.Get("a", "1", 0)
+	cache.Get("d", "1", 0)
+
+	cache, err = OpenCache(dir, 20, 0)
+	if err != nil {
+		t.Fatal("could not reopen cache - ", err)
+	}
+	if _, ok := cache.Get("c", "1", 0); ok {
+		t.Errorf("least recently used chunk kept over the new limit")
+	}
+	if _, ok := cache.Get("a", "1", 0); !ok {
+		t.Errorf("recently used chunk lost on reopening")
+	}
+
+	// Files that are not chunks are never taken in, nor evicted
+	other := filepath.Join(dir, "important.txt")
+	if err := ioutil.WriteFile(other, bytes.Repeat([]byte("i"), 2000), 0600); err != nil {
+		t.Fatal("could not write file - ", err)
+	}
+	if err := ioutil.WriteFile(other+cacheTemp, nil, 0600); err != nil {
+		t.Fatal("could not write file - ", err)
+	}
+	cache, err = OpenCache(dir, 20, 0)
+	if err != nil {
+		t.Fatal("could not reopen cache - ", err)
+	}
+	if size := cache.Size(); size > 20 {
+		t.Errorf("cache holds %d bytes with a file of someone else's, want at most 20", size)
+	}
+	for _, name := range []string{other, other + cacheTemp} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("file not of the cache was removed - %v", err)
+		}
+	}
+
+	// Everything is too old once reopened with a short age
+	time.Sleep(20 * time.Millisecond)
+	cache, err = OpenCache(dir, 0, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal("could not reopen cache - ", err)
+	}
+	if size := cache.Size(); size != 0 {
+		t.Errorf("cache holds %d bytes past the age limit, want 0", size)
+	}
+}
+
+// Run with -race, sessions walk, write and list while the tree is synced and changed remotely
+func TestConcurrentSessions(t *testing.T) {
+	const sessions = 8
+
+	store := NewMemBackend()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store.Put(ctx, "shared/data", bytes.Repeat([]byte("s"), 3000), BlobProps{}, "")
+
+	srv := newServer(t, store)
+	srv.ctx = ctx
+	srv.ttl = time.Millisecond
+	srv.idle = time.Millisecond
+	addr := listen(t, srv)
+
+	src := make(chanSource)
+	go srv.Refresh(time.Millisecond)
+	go srv.Watch(src)
+
+	// Someone else keeps changing the shared directory
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ctx.Err() == nil; i++ {
+			name := fmt.Sprintf("shared/remote%d", i%4)
+			if i%2 == 0 {
+				store.Put(ctx, name, []byte(name), BlobProps{}, "")
+			} else {
+				store.Delete(ctx, name, "")
+			}
+
+			select {
+			case src <- []Event{{Name: name, Deleted: i%2 == 1}}:
+			case <-ctx.Done():
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	t.Run("sessions", func(t *testing.T) {
+		for i := 0; i < sessions; i++ {
+			i := i
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				t.Parallel()
+				c := dial(t, addr)
+
+				dir := fmt.Sprintf("/s%d", i)
+				if err := c.mkdir(dir); err != nil {
+					t.Fatal("mkdir failed - ", err)
+				}
+
+				for j := 0; j < 10; j++ {
+					full := fmt.Sprintf("%s/f%d", dir, j)
+					data := []byte(strings.Repeat(full, j+1))
+
+					if err := c.createFile(full, data); err != nil {
+						t.Fatal("create failed - ", err)
+					}
+					if got, err := c.readFile(full); err != nil || !bytes.Equal(got, data) {
+						t.Fatalf("read %q, %v from %s, want %q", got, err, full, data)
+					}
+
+					if got, err := c.readFile("/shared/data"); err != nil || len(got) != 3000 {
+						t.Fatalf("read %d bytes, %v from the shared file", len(got), err)
+					}
+					if _, err := c.list("/shared"); err != nil {
+						t.Fatal("list failed - ", err)
+					}
+					if _, err := c.statFile(dir); err != nil {
+						t.Fatal("stat failed - ", err)
+					}
+				}
+
+				// A directory's length is its number of children
+				stat, err := c.statFile(dir)
+				if err != nil {
+					t.Fatal("stat failed - ", err)
+				}
+				if stat.Length() != 10 {
+					t.Errorf("%s holds %d files, want 10", dir, stat.Length())
+				}
+
+				if err := c.removeFile(dir + "/f0"); err != nil {
+					t.Fatal("remove failed - ", err)
+				}
+			})
+		}
+	})
+
+	cancel()
+	<-done
+
+	for i := 0; i < sessions; i++ {
+		for j := 1; j < 10; j++ {
+			full := fmt.Sprintf("s%d/f%d", i, j)
+			if got := blobData(t, store, full); !bytes.Equal(got, []byte(strings.Repeat("/"+full, j+1))) {
+				t.Errorf("blob %s holds %q", full, got)
+			}
+		}
+	}
+}
+
+// A backend whose uploads wait for the test
+type stallingBackend struct {
+	*MemBackend
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *stallingBackend) Put(ctx context.Context, name string, data []byte, props BlobProps, match string) (BlobInfo, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.MemBackend.Put(ctx, name, data, props, match)
+}
+
+func TestListingDuringUpload(t *testing.T) {
+	store := &stallingBackend{MemBackend: NewMemBackend(), started: make(chan struct{}), release: make(chan struct{})}
+	ctx := context.Background()
+	store.MemBackend.Put(ctx, "f", []byte("ours"), BlobProps{}, "")
+	store.MemBackend.Put(ctx, "g", []byte("g"), BlobProps{}, "")
+
+	srv, addr := serve(t, store)
+	srv.ttl = 0
+	writer := dial(t, addr)
+	reader := dial(t, addr)
+
+	fid, err := writer.walk("/f")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := writer.open(fid, styxproto.OWRITE); err != nil {
+		t.Fatal("open failed - ", err)
+	}
+	if err := writer.write(fid, 0, []byte("OURS!")); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- writer.clunk(fid)
+	}()
+	<-store.started
+
+	// The upload holds the blob, listings and stats of it carry on
+	store.MemBackend.Put(ctx, "g", []byte("changed"), BlobProps{}, "")
+	names, err := reader.list("/")
+	if err != nil || len(names) != 2 {
+		t.Errorf("listed %q, %v during an upload, want [f g]", names, err)
+	}
+	stat, err := reader.statFile("/f")
+	if err != nil || stat.Length() != 5 {
+		t.Errorf("stat gave length %d, %v during an upload, want 5", stat.Length(), err)
+	}
+	if got, err := reader.readFile("/g"); err != nil || string(got) != "changed" {
+		t.Errorf("read %q, %v during an upload, want %q", got, err, "changed")
+	}
+
+	close(store.release)
+	if err := <-done; err != nil {
+		t.Error("clunk failed - ", err)
+	}
+}
+
+// A backend whose listings, once paused is set, wait for the test after fetching their page
+type pausingBackend struct {
+	*MemBackend
+	paused  int32
+	fetched chan struct{}
+	resume  chan struct{}
+}
+
+func (p *pausingBackend) List(ctx context.Context, prefix, delim, marker string) (ListPage, error) {
+	page, err := p.MemBackend.List(ctx, prefix, delim, marker)
+	if atomic.CompareAndSwapInt32(&p.paused, 1, 0) {
+		p.fetched <- struct{}{}
+		<-p.resume
+	}
+
+	return page, err
+}
+
+func TestStaleListing(t *testing.T) {
+	store := &pausingBackend{MemBackend: NewMemBackend(), fetched: make(chan struct{}), resume: make(chan struct{})}
+	ctx := context.Background()
+	store.Put(ctx, "f", []byte("old"), BlobProps{}, "")
+
+	srv, addr := serve(t, store)
+	srv.ttl = time.Hour
+	c := dial(t, addr)
+
+	// A listing fetched before our upload lands after it
+	atomic.StoreInt32(&store.paused, 1)
+	done := make(chan error)
+	go func() {
+		done <- srv.File.Sync()
+	}()
+	<-store.fetched
+
+	if err := c.writeFile("/f", 0, []byte("ours!")); err != nil {
+		t.Fatal("write failed - ", err)
+	}
+
+	close(store.resume)
+	if err := <-done; err != nil {
+		t.Fatal("sync failed - ", err)
+	}
+
+	// It must not roll back what we know of our own upload
+	stat, err := c.statFile("/f")
+	if err != nil || stat.Length() != 5 {
+		t.Errorf("stat gave length %d, %v after a stale listing, want 5", stat.Length(), err)
+	}
+	if err := c.removeFile("/f"); err != nil {
+		t.Error("remove after a stale listing failed - ", err)
+	}
+}
+
+func TestListingPerFid(t *testing.T) {
+	store := NewMemBackend()
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		store.Put(ctx, fmt.Sprintf("d/f%d", i), []byte("x"), BlobProps{}, "")
+	}
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	var fids [2]uint32
+	for i := range fids {
+		fid, err := c.walk("/d")
+		if err != nil {
+			t.Fatal("walk failed - ", err)
+		}
+		if err := c.open(fid, styxproto.OREAD); err != nil {
+			t.Fatal("open failed - ", err)
+		}
+		defer c.clunk(fid)
+
+		fids[i] = fid
+	}
+
+	// Reads small enough for one entry each, taking turns
+	var names [2][]string
+	var offsets [2]int64
+	for done := 0; done < len(fids); {
+		done = 0
+		for i, fid := range fids {
+			data, err := c.readAt(fid, offsets[i], 100)
+			if err != nil {
+				t.Fatal("read failed - ", err)
+			}
+			if len(data) == 0 {
+				done++
+				continue
+			}
+
+			names[i] = append(names[i], statNames(t, data)...)
+			offsets[i] += int64(len(data))
+		}
+	}
+
+	want := []string{"f0", "f1", "f2", "f3", "f4"}
+	for i := range fids {
+		sort.Strings(names[i])
+		if !reflect.DeepEqual(names[i], want) {
+			t.Errorf("fid %d listed %q, want %q", i, names[i], want)
+		}
+	}
+
+	// Entries carry the qids walks and stats of them get
+	fid, err := c.walk("/d")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := c.open(fid, styxproto.OREAD); err != nil {
+		t.Fatal("open failed - ", err)
+	}
+	defer c.clunk(fid)
+
+	data, err := c.readAt(fid, 0, c.msize-styxproto.IOHeaderSize)
+	if err != nil {
+		t.Fatal("read failed - ", err)
+	}
+	for len(data) >= 2 {
+		n := 2 + int(binary.LittleEndian.Uint16(data))
+		entry := styxproto.Stat(data[:n])
+		data = data[n:]
+
+		stat, err := c.statFile("/d/" + string(entry.Name()))
+		if err != nil {
+			t.Fatal("stat failed - ", err)
+		}
+		if entry.Qid().Path() != stat.Qid().Path() {
+			t.Errorf("%s listed with qid %d, stat gave %d", entry.Name(), entry.Qid().Path(), stat.Qid().Path())
+		}
+	}
+}
+
+func TestListingAfterCreate(t *testing.T) {
+	_, addr := serve(t, NewMemBackend())
+	c := dial(t, addr)
+
+	if err := c.mkdir("/d"); err != nil {
+		t.Fatal("mkdir failed - ", err)
+	}
+	if err := c.createFile("/d/a", []byte("a")); err != nil {
+		t.Fatal("create failed - ", err)
+	}
+
+	names, err := c.list("/d")
+	if err != nil {
+		t.Fatal("list failed - ", err)
+	}
+	if !reflect.DeepEqual(names, []string{"a"}) {
+		t.Errorf("listed %q, want [a]", names)
+	}
+}
+
+func TestHugeDirectory(t *testing.T) {
+	store := &countingBackend{MemBackend: NewMemBackend()}
+	store.pageMax = 7
+	ctx := context.Background()
+
+	var want []string
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		store.Put(ctx, "big/"+name, []byte(name), BlobProps{}, "")
+		want = append(want, name)
+	}
+	store.Put(ctx, "big/sub/x", []byte("x"), BlobProps{}, "")
+	want = append(want, "sub")
+	store.Put(ctx, "top", []byte("t"), BlobProps{}, "")
+
+	srv, addr := serve(t, store)
+	srv.recursive = true
+	c := dial(t, addr)
+
+	// Only the top level is listed up front
+	if n := atomic.LoadInt32(&store.lists); n != 1 {
+		t.Errorf("%d listings to populate, want 1", n)
+	}
+	if _, err := srv.File.Search("/big/f00"); err == nil {
+		t.Error("directory listed before first use")
+	}
+
+	// A directory read fetches only the page it reads from
+	fid, err := c.walk("/big")
+	if err != nil {
+		t.Fatal("walk failed - ", err)
+	}
+	if err := c.open(fid, styxproto.OREAD); err != nil {
+		t.Fatal("open failed - ", err)
+	}
+	atomic.StoreInt32(&store.lists, 0)
+	data, err := c.readAt(fid, 0, 100)
+	if err != nil || len(statNames(t, data)) != 1 {
+		t.Fatalf("read %d bytes, %v from the first page", len(data), err)
+	}
+	if n := atomic.LoadInt32(&store.lists); n != 1 {
+		t.Errorf("%d listings for the first entry, want 1", n)
+	}
+	c.clunk(fid)
+
+	names, err := c.list("/big")
+	if err != nil {
+		t.Fatal("list failed - ", err)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("listed %q, want %q", names, want)
+	}
+
+	got, err := c.readFile("/big/sub/x")
+	if err != nil || string(got) != "x" {
+		t.Errorf("read %q, %v, want %q", got, err, "x")
+	}
+
+	// Deletes on a later page are seen too
+	store.Delete(ctx, "big/f49", "")
+	names, err = c.list("/big")
+	if err != nil {
+		t.Fatal("list failed - ", err)
+	}
+	if len(names) != 50 || names[49] != "sub" {
+		t.Errorf("listed %q after remote delete, want f49 gone", names)
+	}
+
+	if err := c.removeFile("/big"); err != nil {
+		t.Fatal("recursive remove failed - ", err)
+	}
+
+	page, _ := store.List(ctx, "", "", "")
+	if len(page.Blobs) != 1 || page.Blobs[0].Name != "top" || page.Next != "" {
+		t.Errorf("blobs %v left after recursive remove, want only top", page.Blobs)
+	}
+}
+
+func TestMemListPages(t *testing.T) {
+	store := NewMemBackend()
+	store.pageMax = 2
+	ctx := context.Background()
+	for _, name := range []string{"a", "b/1", "b/2", "c", "d/", "e"} {
+		store.Put(ctx, name, nil, BlobProps{}, "")
+	}
+
+	var got []string
+	pages := 0
+	err := listPages(ctx, store, "", "/", func(page ListPage) error {
+		pages++
+		for _, info := range page.Blobs {
+			got = append(got, info.Name)
+		}
+		got = append(got, page.Prefixes...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("listing failed - ", err)
+	}
+
+	sort.Strings(got)
+	if want := []string{"a", "b/", "c", "d/", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listed %q, want %q", got, want)
+	}
+	if pages != 3 {
+		t.Errorf("listed in %d pages, want 3", pages)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	srv := newServer(t, NewMemBackend())
+	for _, f := range []struct {
+		full  string
+		isDir bool
+	}{{"/a", true}, {"/a/b", true}, {"/a/b/f", false}, {"/g", false}} {
+		if _, err := srv.File.Insert(f.full, f.isDir); err != nil {
+			t.Fatal("insert failed - ", err)
+		}
+	}
+
+	for _, test := range []struct {
+		full string
+		want string // Path found
+		err  error
+	}{
+		{"/", "/", nil},
+		{"", "/", nil},
+		{"/a", "/a", nil},
+		{"/a/b/f", "/a/b/f", nil},
+		{"a/b", "/a/b", nil},
+		{"//a//b/", "/a/b", nil},
+		{"/a/./b", "/a/b", nil},
+		{"/a/b/..", "/a", nil},
+		{"/a/b/../../g", "/g", nil},
+		{"/..", "/", nil},
+		{"/../a/.", "/a", nil},
+		{"/x", "", os.ErrNotExist},
+		{"/a/x/f", "", os.ErrNotExist},
+		{"/a/b/../x", "", os.ErrNotExist},
+		{"/g/x", "", ErrNotDir},
+		{"/g/.", "", ErrNotDir},
+		{"/a/b/f/..", "", ErrNotDir},
+	} {
+		f, err := srv.File.Search(test.full)
+		if test.err != nil {
+			var lerr *LookupError
+			if !errors.As(err, &lerr) || !errors.Is(err, test.err) {
+				t.Errorf("Search(%q) gave %v, want %v", test.full, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Search(%q) failed - %v", test.full, err)
+			continue
+		}
+		if got := f.Path(); got != test.want {
+			t.Errorf("Search(%q) found %q, want %q", test.full, got, test.want)
+		}
+	}
+
+	// Failed inserts hand back no file, least of all the root
+	for _, full := range []string{"/a", "/g/x", "/x/y"} {
+		if f, err := srv.File.Insert(full, false); err == nil || f != nil {
+			t.Errorf("Insert(%q) gave %v, %v, want no file and an error", full, f, err)
+		}
+	}
+}
+
+func TestWalkDeep(t *testing.T) {
+	store := NewMemBackend()
+	store.Put(context.Background(), "a/b/c/d", []byte("deep"), BlobProps{}, "")
+
+	_, addr := serve(t, store)
+	c := dial(t, addr)
+
+	got, err := c.readFile("/a/b/c/d")
+	if err != nil || string(got) != "deep" {
+		t.Errorf("read %q, %v, want %q", got, err, "deep")
+	}
+
+	if _, err := c.statFile("/missing"); err == nil || err.Error() != os.ErrNotExist.Error() {
+		t.Errorf("stat of a missing file gave %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+// A service failure as azblob reports it
+type fakeStorageError struct {
+	code azblob.ServiceCodeType
+}
+
+func (e fakeStorageError) Error() string                       { return "service failed - " + string(e.code) }
+func (e fakeStorageError) Temporary() bool                     { return false }
+func (e fakeStorageError) Timeout() bool                       { return false }
+func (e fakeStorageError) Response() *http.Response            { return &http.Response{Status: "400 Bad Request"} }
+func (e fakeStorageError) ServiceCode() azblob.ServiceCodeType { return e.code }
+
+func TestStorageErrors(t *testing.T) {
+	other := errors.New("connection reset")
+
+	for _, test := range []struct {
+		err  error
+		want error
+	}{
+		{fakeStorageError{azblob.ServiceCodeBlobNotFound}, os.ErrNotExist},
+		{fakeStorageError{azblob.ServiceCodeContainerNotFound}, os.ErrNotExist},
+		{fakeStorageError{azblob.ServiceCodeType(azblob.StorageErrorCodeAuthorizationFailure)}, os.ErrPermission},
+		{fakeStorageError{azblob.ServiceCodeAuthenticationFailed}, os.ErrPermission},
+		{fakeStorageError{azblob.ServiceCodeLeaseIDMissing}, os.ErrPermission},
+		{fakeStorageError{azblob.ServiceCodeConditionNotMet}, ErrConflict},
+		{fakeStorageError{azblob.ServiceCodeAppendPositionConditionNotMet}, ErrConflict},
+		{fakeStorageError{azblob.ServiceCodeBlobAlreadyExists}, os.ErrExist},
+		{fmt.Errorf("write error: %w", fakeStorageError{azblob.ServiceCodeConditionNotMet}), ErrConflict},
+		{fakeStorageError{azblob.ServiceCodeServerBusy}, fakeStorageError{azblob.ServiceCodeServerBusy}},
+		{other, other},
+	} {
+		if got := storageError(test.err); got != test.want {
+			t.Errorf("storageError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestErrors9P(t *testing.T) {
+	for _, test := range []struct {
+		what string
+		err  error
+		want string
+	}{
+		{"", &LookupError{Path: "/a/x", Err: os.ErrNotExist}, "file does not exist"},
+		{"", &LookupError{Path: "/f/x", Err: ErrNotDir}, "not a directory"},
+		{"tree insert failed", &os.PathError{Op: "create", Path: "/f", Err: os.ErrExist}, "file already exists"},
+		{"backend delete failed", os.ErrPermission, "permission denied"},
+		{"backend delete failed", ErrNotEmpty, ErrNotEmpty.Error()},
+		{"backend delete failed", ErrConflict, ErrConflict.Error()},
+		{"backend delete failed", errors.New("boom"), "backend delete failed boom"},
+		{"", errors.New("boom"), "boom"},
+	} {
+		if got := error9P(test.what, test.err); got == nil || got.Error() != test.want {
+			t.Errorf("error9P(%q, %v) = %v, want %q", test.what, test.err, got, test.want)
+		}
+	}
+
+	if err := error9P("what", nil); err != nil {
+		t.Errorf("error9P of no error gave %v", err)
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	store := NewMemBackend()
+	store.Put(context.Background(), "d/f", []byte("f"), BlobProps{}, "")
+
+	srv, addr := serve(t, store)
+	srv.ttl = time.Hour
+	c := dial(t, addr)
+
+	if _, err := c.statFile("/missing"); err == nil || err.Error() != os.ErrNotExist.Error() {
+		t.Errorf("stat of a missing file gave %v, want %v", err, os.ErrNotExist)
+	}
+	if err := c.createFile("/d/f", []byte("again")); err == nil || err.Error() != os.ErrExist.Error() {
+		t.Errorf("create over an existing file gave %v, want %v", err, os.ErrExist)
+	}
+
+	// Deleted behind our back, the failed delete is replied to once and the session carries on
+	store.Delete(context.Background(), "d/f", "")
+	if err := c.removeFile("/d/f"); err == nil || err.Error() != os.ErrNotExist.Error() {
+		t.Errorf("remove of a remotely deleted file gave %v, want %v", err, os.ErrNotExist)
+	}
+	if _, err := c.statFile("/d"); err != nil {
+		t.Error("stat after a failed remove failed - ", err)
+	}
+}
+
+// A backend whose uploads fail while failing is set
+type flakyBackend struct {
+	*MemBackend
+	failing int32
+}
+
+func (f *flakyBackend) Put(ctx context.Context, name string, data []byte, props BlobProps, match string) (BlobInfo, error) {
+	if atomic.LoadInt32(&f.failing) != 0 {
+		return BlobInfo{}, errors.New("transient")
+	}
+
+	return f.MemBackend.Put(ctx, name, data, props, match)
+}
+
+func TestTruncateFailure(t *testing.T) {
+	store := &flakyBackend{MemBackend: NewMemBackend()}
+	ctx := context.Background()
+	store.Put(ctx, "f", []byte("keep me"), BlobProps{}, "")
+
+	_, addr := serveOrdered(t, store)
+	c := dial(t, addr)
+
+	atomic.StoreInt32(&store.failing, 1)
+	if err := c.truncate("/f", 0); err == nil {
+		t.Fatal("truncate succeeded with uploads failing")
+	}
+	atomic.StoreInt32(&store.failing, 0)
+
+	// Nothing is left buffered for a later clunk to upload
+	got, err := c.readFile("/f")
+	if err != nil || string(got) != "keep me" {
+		t.Errorf("read %q, %v after a failed truncate, want %q", got, err, "keep me")
+	}
+	if got := blobData(t, store, "f"); string(got) != "keep me" {
+		t.Errorf("blob holds %q after a failed truncate, want %q", got, "keep me")
+	}
+}
+
+// A backend whose listings fail once denied is set
+type denyingBackend struct {
+	*MemBackend
+	denied int32
+}
+
+func (d *denyingBackend) List(ctx context.Context, prefix, delim, marker string) (ListPage, error) {
+	if atomic.LoadInt32(&d.denied) != 0 {
+		return ListPage{}, os.ErrPermission
+	}
+
+	return d.MemBackend.List(ctx, prefix, delim, marker)
+}
+
+func (d *denyingBackend) Stat(ctx context.Context, name string) (BlobInfo, error) {
+	if atomic.LoadInt32(&d.denied) != 0 {
+		return BlobInfo{}, os.ErrPermission
+	}
+
+	return d.MemBackend.Stat(ctx, name)
+}
+
+func TestLookupListingErrors(t *testing.T) {
+	store := &denyingBackend{MemBackend: NewMemBackend()}
+	store.Put(context.Background(), "d/f", []byte("f"), BlobProps{}, "")
+
+	srv, addr := serve(t, store)
+	srv.ttl = 0
+	c := dial(t, addr)
+
+	// A listing that fails is no proof the file is missing
+	atomic.StoreInt32(&store.denied, 1)
+	for _, name := range []string{"/", "/d/f"} {
+		if _, err := c.statFile(name); err == nil || err.Error() != os.ErrPermission.Error() {
+			t.Errorf("stat of %s with listings denied gave %v, want %v", name, err, os.ErrPermission)
+		}
+	}
+
+	atomic.StoreInt32(&store.denied, 0)
+	if _, err := c.statFile("/d/f"); err != nil {
+		t.Error("stat failed once listings were allowed - ", err)
+	}
+}
+
+func TestCreateKeepsRemoteBlob(t *testing.T) {
+	store := NewMemBackend()
+	store.Put(context.Background(), "d/g", []byte("g"), BlobProps{}, "")
+
+	srv, addr := serve(t, store)
+	srv.ttl = time.Hour
+	c := dial(t, addr)
+
+	if _, err := c.list("/d"); err != nil {
+		t.Fatal("list failed - ", err)
+	}
+
+	// Written behind our back after the listing, the tree has yet to see it
+	store.Put(context.Background(), "d/f", []byte("precious"), BlobProps{}, "")
+	if err := c.createFile("/d/f", []byte("mine")); err == nil || err.Error() != os.ErrExist.Error() {
+		t.Errorf("create over a remote blob gave %v, want %v", err, os.ErrExist)
+	}
+
+	if data := blobData(t, store, "d/f"); string(data) != "precious" {
+		t.Errorf("remote blob is %q after a create, want %q", data, "precious")
+	}
+}
+
+func TestEventStatErrors(t *testing.T) {
+	store := &denyingBackend{MemBackend: NewMemBackend()}
+	store.Put(context.Background(), "f", []byte("f"), BlobProps{}, "")
+	srv := newServer(t, store)
+
+	// A delete event is only applied once the blob is known to be gone
+	atomic.StoreInt32(&store.denied, 1)
+	if err := srv.apply(Event{Name: "f", Deleted: true}); err != os.ErrPermission {
+		t.Errorf("delete event with stat denied gave %v, want %v", err, os.ErrPermission)
+	}
+	if _, err := srv.File.Search("/f"); err != nil {
+		t.Error("file gone from tree after a failed stat - ", err)
+	}
+}
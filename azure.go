@@ -0,0 +1,486 @@
+// Copyright (c) 2020 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Azure blob storage implementation of Backend
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+	copyPoll = 500 * time.Millisecond // Interval between checks on a pending copy
+)
+
+// Backend for a single Azure blob storage container
+type AzureBackend struct {
+	container azblob.ContainerURL
+}
+
+// Create a new backend for a container
+func NewAzureBackend(container azblob.ContainerURL) *AzureBackend {
+	return &AzureBackend{container: container}
+}
+
+// Access conditions requiring a blob still have the ETag match, none if empty
+// IfAbsent requires there be no blob at all
+func ifMatch(match string) azblob.ModifiedAccessConditions {
+	if match == IfAbsent {
+		return azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}
+	}
+
+	return azblob.ModifiedAccessConditions{IfMatch: azblob.ETag(match)}
+}
+
+// Errors reported for service codes a caller can act on - See: Backend
+// Anything else is passed on as the service reported it
+var storageErrors = map[string]error{
+	string(azblob.ServiceCodeConditionNotMet):                        ErrConflict,
+	string(azblob.ServiceCodeAppendPositionConditionNotMet):          ErrConflict,
+	string(azblob.ServiceCodeSequenceNumberConditionNotMet):          ErrConflict,
+	string(azblob.ServiceCodeSourceConditionNotMet):                  ErrConflict,
+	string(azblob.ServiceCodeTargetConditionNotMet):                  ErrConflict,
+	string(azblob.ServiceCodeBlobNotFound):                           os.ErrNotExist,
+	string(azblob.ServiceCodeContainerNotFound):                      os.ErrNotExist,
+	string(azblob.ServiceCodeContainerBeingDeleted):                  os.ErrNotExist,
+	string(azblob.ServiceCodeResourceNotFound):                       os.ErrNotExist,
+	string(azblob.ServiceCodeBlobAlreadyExists):                      os.ErrExist,
+	string(azblob.ServiceCodeAuthenticationFailed):                   os.ErrPermission,
+	string(azblob.StorageErrorCodeAuthorizationFailure):              os.ErrPermission,
+	string(azblob.StorageErrorCodeAuthorizationPermissionMismatch):   os.ErrPermission,
+	string(azblob.StorageErrorCodeAuthorizationResourceTypeMismatch): os.ErrPermission,
+	string(azblob.StorageErrorCodeAuthorizationServiceMismatch):      os.ErrPermission,
+	string(azblob.StorageErrorCodeAuthorizationSourceIPMismatch):     os.ErrPermission,
+	string(azblob.StorageErrorCodeAuthorizationProtocolMismatch):     os.ErrPermission,
+	string(azblob.ServiceCodeInsufficientAccountPermissions):         os.ErrPermission,
+	string(azblob.ServiceCodeAccountIsDisabled):                      os.ErrPermission,
+	string(azblob.ServiceCodeBlobArchived):                           os.ErrPermission,
+	string(azblob.ServiceCodeLeaseIDMissing):                         os.ErrPermission,
+	string(azblob.ServiceCodeLeaseIDMismatchWithBlobOperation):       os.ErrPermission,
+	string(azblob.ServiceCodeLeaseIDMismatchWithContainerOperation):  os.ErrPermission,
+}
+
+// Convert a failure from the service into the error a Backend reports for it
+// The service's own account of it is logged, the mapped errors carry no detail
+// azblob wraps some failures on the way out, the service's is found beneath
+func storageError(err error) error {
+	var serr azblob.StorageError
+	if !errors.As(err, &serr) {
+		return err
+	}
+
+	mapped, ok := storageErrors[string(serr.ServiceCode())]
+	if !ok {
+		return err
+	}
+
+	log.Println("!!!! storage error", serr.ServiceCode(), "- ", serr.Response().Status)
+
+	return mapped
+}
+
+// Convert an azure blob type into ours
+func azureType(t azblob.BlobType) BlobType {
+	switch t {
+	case azblob.BlobBlockBlob:
+		return BlockBlob
+	case azblob.BlobAppendBlob:
+		return AppendBlob
+	case azblob.BlobPageBlob:
+		return PageBlob
+	}
+
+	return ""
+}
+
+// Convert listing properties into BlobInfo
+func itemInfo(item azblob.BlobItemInternal) BlobInfo {
+	info := BlobInfo{
+		Name:         item.Name,
+		Type:         azureType(item.Properties.BlobType),
+		ETag:         string(item.Properties.Etag),
+		LastModified: item.Properties.LastModified,
+		Metadata:     item.Metadata,
+	}
+
+	if item.Properties.ContentLength != nil {
+		info.Size = *item.Properties.ContentLength
+	}
+
+	if item.Properties.ContentType != nil {
+		info.ContentType = *item.Properties.ContentType
+	}
+
+	return info
+}
+
+// List a page of blobs whose names begin with prefix, rolling names up to delim into prefixes
+// Pages are as the service returns them, up to 5000 names each
+func (a *AzureBackend) List(ctx context.Context, prefix, delim, marker string) (ListPage, error) {
+	var page ListPage
+	opts := azblob.ListBlobsSegmentOptions{
+		Details: azblob.BlobListingDetails{Metadata: true},
+		Prefix:  prefix,
+	}
+
+	// No marker value asks for the first page
+	at := azblob.Marker{}
+	if marker != "" {
+		at.Val = &marker
+	}
+
+	var next azblob.Marker
+
+	// Without a delimiter there is no hierarchy to speak of
+	if delim == "" {
+		blob, err := a.container.ListBlobsFlatSegment(ctx, at, opts)
+		if err != nil {
+			return page, storageError(err)
+		}
+
+		next = blob.NextMarker
+
+		for _, item := range blob.Segment.BlobItems {
+			page.Blobs = append(page.Blobs, itemInfo(item))
+		}
+	} else {
+		blob, err := a.container.ListBlobsHierarchySegment(ctx, at, delim, opts)
+		if err != nil {
+			return page, storageError(err)
+		}
+
+		next = blob.NextMarker
+
+		for _, item := range blob.Segment.BlobItems {
+			page.Blobs = append(page.Blobs, itemInfo(item))
+		}
+
+		for _, p := range blob.Segment.BlobPrefixes {
+			page.Prefixes = append(page.Prefixes, p.Name)
+		}
+	}
+
+	// The last page carries an empty marker
+	if next.Val != nil {
+		page.Next = *next.Val
+	}
+
+	return page, nil
+}
+
+// Properties of a single blob
+func (a *AzureBackend) Stat(ctx context.Context, name string) (BlobInfo, error) {
+	url := a.container.NewBlobURL(name)
+
+	props, err := url.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	return BlobInfo{
+		Name:         name,
+		Type:         azureType(props.BlobType()),
+		Size:         props.ContentLength(),
+		ETag:         string(props.ETag()),
+		ContentType:  props.ContentType(),
+		LastModified: props.LastModified(),
+		Metadata:     props.NewMetadata(),
+	}, nil
+}
+
+// Read count bytes starting at off, a negative count reads to the end
+func (a *AzureBackend) Get(ctx context.Context, name string, off, count int64) ([]byte, string, error) {
+	url := a.container.NewBlobURL(name)
+
+	if count < 0 {
+		count = azblob.CountToEnd
+	}
+
+	resp, err := url.Download(ctx, off, count, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, "", storageError(err)
+	}
+
+	opts := azblob.RetryReaderOptions{
+		MaxRetryRequests: maxRetry,
+	}
+
+	bodyStream := resp.Body(opts)
+	defer bodyStream.Close()
+
+	// Read the body into a buffer
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(bodyStream)
+
+	return buf.Bytes(), string(resp.ETag()), err
+}
+
+// Create or replace a blob in full with the given properties, returns its new properties
+func (a *AzureBackend) Put(ctx context.Context, name string, data []byte, props BlobProps, match string) (BlobInfo, error) {
+	url := a.container.NewBlockBlobURL(name)
+
+	opts := azblob.UploadStreamToBlockBlobOptions{
+		BufferSize:       bufSize,
+		MaxBuffers:       maxBuffers,
+		BlobHTTPHeaders:  azblob.BlobHTTPHeaders{ContentType: props.ContentType},
+		Metadata:         azblob.Metadata(props.Metadata),
+		AccessConditions: azblob.BlobAccessConditions{ModifiedAccessConditions: ifMatch(match)},
+	}
+
+	resp, err := azblob.UploadStreamToBlockBlob(ctx, bytes.NewReader(data), url, opts)
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	return BlobInfo{
+		Name:         name,
+		Type:         BlockBlob,
+		Size:         int64(len(data)),
+		ETag:         string(resp.ETag()),
+		LastModified: resp.LastModified(),
+	}, nil
+}
+
+// The committed blocks of a blob in order, none for a blob uploaded whole
+func (a *AzureBackend) Blocks(ctx context.Context, name string) ([]BlockInfo, error) {
+	url := a.container.NewBlockBlobURL(name)
+
+	resp, err := url.GetBlockList(ctx, azblob.BlockListCommitted, azblob.LeaseAccessConditions{})
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	blocks := make([]BlockInfo, 0, len(resp.CommittedBlocks))
+	for _, block := range resp.CommittedBlocks {
+		blocks = append(blocks, BlockInfo{ID: block.Name, Size: int64(block.Size)})
+	}
+
+	return blocks, nil
+}
+
+// Upload a block, it is not part of the blob until committed
+func (a *AzureBackend) StageBlock(ctx context.Context, name, id string, data []byte) error {
+	url := a.container.NewBlockBlobURL(name)
+
+	_, err := url.StageBlock(ctx, id, bytes.NewReader(data), azblob.LeaseAccessConditions{}, nil, azblob.ClientProvidedKeyOptions{})
+
+	return storageError(err)
+}
+
+// Replace the contents and properties of a blob with the listed staged or committed blocks
+func (a *AzureBackend) CommitBlocks(ctx context.Context, name string, ids []string, props BlobProps, match string) (BlobInfo, error) {
+	url := a.container.NewBlockBlobURL(name)
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: ifMatch(match)}
+	headers := azblob.BlobHTTPHeaders{ContentType: props.ContentType}
+
+	resp, err := url.CommitBlockList(ctx, ids, headers, azblob.Metadata(props.Metadata), ac, azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	return BlobInfo{
+		Name:         name,
+		Type:         BlockBlob,
+		ETag:         string(resp.ETag()),
+		LastModified: resp.LastModified(),
+	}, nil
+}
+
+// Create an empty append blob, replacing any blob of the name matching the ETag
+func (a *AzureBackend) CreateAppend(ctx context.Context, name string, match string) (BlobInfo, error) {
+	url := a.container.NewAppendBlobURL(name)
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: ifMatch(match)}
+
+	resp, err := url.Create(ctx, azblob.BlobHTTPHeaders{}, azblob.Metadata{}, ac, nil, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	return BlobInfo{
+		Name:         name,
+		Type:         AppendBlob,
+		ETag:         string(resp.ETag()),
+		LastModified: resp.LastModified(),
+	}, nil
+}
+
+// Add at most maxPut bytes to the end of an append blob
+func (a *AzureBackend) Append(ctx context.Context, name string, data []byte) (BlobInfo, error) {
+	url := a.container.NewAppendBlobURL(name)
+
+	resp, err := url.AppendBlock(ctx, bytes.NewReader(data), azblob.AppendBlobAccessConditions{}, nil, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	// The service reports where the block landed
+	at, err := strconv.ParseInt(resp.BlobAppendOffset(), 10, 64)
+	if err != nil {
+		return BlobInfo{}, errors.New(`bad append offset for blob "` + name + `" - ` + err.Error())
+	}
+
+	return BlobInfo{
+		Name:         name,
+		Type:         AppendBlob,
+		Size:         at + int64(len(data)),
+		ETag:         string(resp.ETag()),
+		LastModified: resp.LastModified(),
+	}, nil
+}
+
+// Create a zeroed page blob of size bytes, replacing any blob of the name matching the ETag
+func (a *AzureBackend) CreatePages(ctx context.Context, name string, size int64, match string) (BlobInfo, error) {
+	url := a.container.NewPageBlobURL(name)
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: ifMatch(match)}
+
+	resp, err := url.Create(ctx, size, 0, azblob.BlobHTTPHeaders{}, azblob.Metadata{}, ac, azblob.DefaultPremiumBlobAccessTier, nil, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	return BlobInfo{
+		Name:         name,
+		Type:         PageBlob,
+		Size:         size,
+		ETag:         string(resp.ETag()),
+		LastModified: resp.LastModified(),
+	}, nil
+}
+
+// Write at most maxPut bytes of pages starting at off
+func (a *AzureBackend) PutPages(ctx context.Context, name string, off int64, data []byte, match string) (BlobInfo, error) {
+	url := a.container.NewPageBlobURL(name)
+	ac := azblob.PageBlobAccessConditions{ModifiedAccessConditions: ifMatch(match)}
+
+	resp, err := url.UploadPages(ctx, off, bytes.NewReader(data), ac, nil, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	return BlobInfo{
+		Name:         name,
+		Type:         PageBlob,
+		ETag:         string(resp.ETag()),
+		LastModified: resp.LastModified(),
+	}, nil
+}
+
+// Zero count bytes of pages starting at off
+func (a *AzureBackend) ClearPages(ctx context.Context, name string, off, count int64, match string) (BlobInfo, error) {
+	url := a.container.NewPageBlobURL(name)
+	ac := azblob.PageBlobAccessConditions{ModifiedAccessConditions: ifMatch(match)}
+
+	resp, err := url.ClearPages(ctx, off, count, ac, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	return BlobInfo{
+		Name:         name,
+		Type:         PageBlob,
+		ETag:         string(resp.ETag()),
+		LastModified: resp.LastModified(),
+	}, nil
+}
+
+// Grow or shrink a page blob to size bytes
+func (a *AzureBackend) ResizePages(ctx context.Context, name string, size int64, match string) (BlobInfo, error) {
+	url := a.container.NewPageBlobURL(name)
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: ifMatch(match)}
+
+	resp, err := url.Resize(ctx, size, ac, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	return BlobInfo{
+		Name:         name,
+		Type:         PageBlob,
+		Size:         size,
+		ETag:         string(resp.ETag()),
+		LastModified: resp.LastModified(),
+	}, nil
+}
+
+// Replace the user-defined metadata of a blob
+func (a *AzureBackend) SetMetadata(ctx context.Context, name string, meta map[string]string, match string) (BlobInfo, error) {
+	url := a.container.NewBlobURL(name)
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: ifMatch(match)}
+
+	resp, err := url.SetMetadata(ctx, azblob.Metadata(meta), ac, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	return BlobInfo{
+		Name:         name,
+		ETag:         string(resp.ETag()),
+		LastModified: resp.LastModified(),
+		Metadata:     meta,
+	}, nil
+}
+
+// Remove a blob
+func (a *AzureBackend) Delete(ctx context.Context, name string, match string) error {
+	url := a.container.NewBlobURL(name)
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: ifMatch(match)}
+
+	// TODO - verify delete snapshot options
+	_, err := url.Delete(ctx, azblob.DeleteSnapshotsOptionNone, ac)
+
+	return storageError(err)
+}
+
+// Copy a blob to a new name within the container and wait for it to finish
+func (a *AzureBackend) Copy(ctx context.Context, src, dst string) (BlobInfo, error) {
+	srcURL := a.container.NewBlobURL(src)
+	dstURL := a.container.NewBlobURL(dst)
+
+	resp, err := dstURL.StartCopyFromURL(ctx, srcURL.URL(), azblob.Metadata{}, azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil)
+	if err != nil {
+		return BlobInfo{}, storageError(err)
+	}
+
+	info := BlobInfo{
+		Name:         dst,
+		ETag:         string(resp.ETag()),
+		LastModified: resp.LastModified(),
+	}
+
+	// Copies within an account usually complete synchronously, poll otherwise
+	status := resp.CopyStatus()
+	for status == azblob.CopyStatusPending {
+		select {
+		case <-ctx.Done():
+			return BlobInfo{}, ctx.Err()
+		case <-time.After(copyPoll):
+		}
+
+		props, err := dstURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return BlobInfo{}, storageError(err)
+		}
+
+		status = props.CopyStatus()
+		if status != azblob.CopyStatusPending && status != azblob.CopyStatusSuccess {
+			return BlobInfo{}, errors.New(`copy of "` + src + `" failed - ` + props.CopyStatusDescription())
+		}
+
+		info.ETag = string(props.ETag())
+		info.LastModified = props.LastModified()
+	}
+
+	if status != azblob.CopyStatusSuccess {
+		return BlobInfo{}, errors.New(`copy of "` + src + `" failed with status ` + string(status))
+	}
+
+	return info, nil
+}
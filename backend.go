@@ -0,0 +1,175 @@
+// Copyright (c) 2020 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Storage backend abstraction for the file tree
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	pageSize = 512             // Page blobs are written in multiples of this
+	maxPut   = 4 * 1024 * 1024 // Most bytes appended or written to pages in one call
+)
+
+// A conditional change found the blob changed by someone else
+var ErrConflict = errors.New("blob changed remotely since it was read")
+
+// ETag to match only where no blob of the name exists, so creates never replace one
+const IfAbsent = "*"
+
+// Kind of blob, fixed when the blob is created
+type BlobType string
+
+const (
+	BlockBlob  BlobType = "block"  // Written whole or block by block
+	AppendBlob BlobType = "append" // Only ever added to at the end
+	PageBlob   BlobType = "page"   // Written in aligned pages, as for disk images
+)
+
+// Parse a blob type by name
+func ParseBlobType(s string) (BlobType, error) {
+	switch t := BlobType(s); t {
+	case BlockBlob, AppendBlob, PageBlob:
+		return t, nil
+	}
+
+	return "", errors.New(`unknown blob type "` + s + `", want block, append or page`)
+}
+
+// Properties of a blob as reported by a Backend
+type BlobInfo struct {
+	Name         string            // Full name of the blob in the store
+	Type         BlobType          // Kind of blob, empty if not reported
+	Size         int64             // Content length in bytes
+	ETag         string            // Opaque version identifier
+	ContentType  string            // MIME type, if known
+	LastModified time.Time         // Time of last modification in the store
+	Metadata     map[string]string // User-defined key/value pairs
+}
+
+// Properties a rewrite of a blob sets, replacing those it had
+type BlobProps struct {
+	ContentType string            // MIME type, the backend's default if empty
+	Metadata    map[string]string // User-defined key/value pairs
+}
+
+// A page of a listing, names come in order across pages
+type ListPage struct {
+	Blobs    []BlobInfo // Blobs listed on the page
+	Prefixes []string   // Names rolled up at the delimiter, ending in it
+	Next     string     // Marker of the next page, empty after the last
+}
+
+// A store of named blobs the file tree is built on top of
+// Azure is one implementation - See: azure.go
+// Calls changing a blob take an ETag to match, they fail with ErrConflict if the blob has changed since
+// An empty ETag changes the blob whatever its state, IfAbsent fails with os.ErrExist if there is one
+// Missing blobs fail with os.ErrNotExist, refused access with os.ErrPermission and name clashes with os.ErrExist
+type Backend interface {
+	// List a page of the blobs whose names begin with prefix, continuing from marker
+	// An empty marker starts from the first page - See: listPages()
+	// With a delimiter, names continuing past the next delimiter are rolled up into prefixes
+	// Without one, every blob under prefix is listed and no prefixes are returned
+	List(ctx context.Context, prefix, delim, marker string) (ListPage, error)
+
+	// Properties of a single blob
+	Stat(ctx context.Context, name string) (BlobInfo, error)
+
+	// Read count bytes starting at off, a negative count reads to the end
+	// Returns the ETag of the contents read
+	Get(ctx context.Context, name string, off, count int64) ([]byte, string, error)
+
+	// Create or replace a blob in full with the given properties, returns its new properties
+	Put(ctx context.Context, name string, data []byte, props BlobProps, match string) (BlobInfo, error)
+
+	// Replace the user-defined metadata of a blob
+	// The returned properties may leave out the size
+	SetMetadata(ctx context.Context, name string, meta map[string]string, match string) (BlobInfo, error)
+
+	// Remove a blob
+	Delete(ctx context.Context, name string, match string) error
+
+	// Copy a blob to a new name within the store, returns the properties of the copy
+	// The returned properties may leave out the size
+	Copy(ctx context.Context, src, dst string) (BlobInfo, error)
+}
+
+// A committed block of a block blob
+type BlockInfo struct {
+	ID   string // Base64 block ID, the same length for every block of a blob
+	Size int64  // Length of the block in bytes
+}
+
+// A Backend able to rewrite a blob block by block, so only changed blocks are sent
+// Checked for with a type assertion - See: Blob.putBlocks()
+type BlockBackend interface {
+	Backend
+
+	// The committed blocks of a blob in order, none for a blob uploaded whole
+	Blocks(ctx context.Context, name string) ([]BlockInfo, error)
+
+	// Upload a block, it is not part of the blob until committed
+	StageBlock(ctx context.Context, name, id string, data []byte) error
+
+	// Replace the contents and properties of a blob with the listed staged or committed blocks
+	// The returned properties may leave out the size, the caller knows it
+	CommitBlocks(ctx context.Context, name string, ids []string, props BlobProps, match string) (BlobInfo, error)
+}
+
+// A Backend able to create and add to append blobs
+type AppendBackend interface {
+	Backend
+
+	// Create an empty append blob, replacing any blob of the name matching the ETag
+	CreateAppend(ctx context.Context, name string, match string) (BlobInfo, error)
+
+	// Add at most maxPut bytes to the end of an append blob, wherever others have left it
+	// The returned size is the length of the blob just after the data was added
+	Append(ctx context.Context, name string, data []byte) (BlobInfo, error)
+}
+
+// A Backend able to create and write page blobs
+// Offsets, sizes and lengths are multiples of pageSize
+type PageBackend interface {
+	Backend
+
+	// Create a zeroed page blob of size bytes, replacing any blob of the name matching the ETag
+	CreatePages(ctx context.Context, name string, size int64, match string) (BlobInfo, error)
+
+	// Write at most maxPut bytes of pages starting at off
+	// The returned properties may leave out the size, the caller knows it
+	PutPages(ctx context.Context, name string, off int64, data []byte, match string) (BlobInfo, error)
+
+	// Zero count bytes of pages starting at off
+	ClearPages(ctx context.Context, name string, off, count int64, match string) (BlobInfo, error)
+
+	// Grow or shrink a page blob to size bytes
+	ResizePages(ctx context.Context, name string, size int64, match string) (BlobInfo, error)
+}
+
+// Call fn on each page of a listing in turn, so no more than a page is held at once
+// Stops at the first error from the store or fn
+func listPages(ctx context.Context, store Backend, prefix, delim string, fn func(ListPage) error) error {
+	marker := ""
+	for {
+		page, err := store.List(ctx, prefix, delim, marker)
+		if err != nil {
+			return err
+		}
+
+		err = fn(page)
+		if err != nil {
+			return err
+		}
+
+		if page.Next == "" {
+			return nil
+		}
+
+		marker = page.Next
+	}
+}
@@ -1,17 +1,21 @@
 // Copyright (c) 2020 Microsoft Corporation, Sean Hinchee.
 // Licensed under the MIT License.
 
-// Contains Azure blob information for use with File
+// Contains blob information for use with File
 package main
 
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
+	"io"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
-
-	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
 const (
@@ -19,82 +23,851 @@ const (
 	maxBuffers = 3               // Max # rotating buffers for upload
 	bufSize    = 2 * 1024 * 1024 // Rotating buffer size for upload
 	maxRetry   = 20              // Maximum number of retries for download
+	mtimeKey   = "abfs_mtime"    // Metadata key for a client chosen modification time
+	blockIDLen = 18              // Random bytes in a block ID, base64 encoded without padding
+)
+
+// Operations a blob's type cannot support
+var (
+	ErrAppendTruncate = errors.New("append blob cannot be truncated")
+	ErrPageSize       = errors.New("page blob size must be a multiple of 512 bytes")
+	ErrBlobType       = errors.New("operation would change the blob type")
 )
 
 // Tracks a blob and its state
 type Blob struct {
-	// TODO - way to check for changes in Azure
-	name *string             // Ref to File.name
-	last time.Time           // Time last accessed by us
-	body bytes.Buffer        // Bytes contents of file
-	url  azblob.BlockBlobURL // Azure blob URL
+	file   *File             // File the blob backs
+	last   time.Time         // Time last accessed by us
+	body   bytes.Buffer      // Bytes contents of file
+	loaded bool              // Does body hold the contents?
+	size   int64             // Content length in bytes
+	etag   string            // ETag of the remote contents we know of
+	ctype  string            // Content type, if known
+	meta   map[string]string // User-defined metadata, if known
+	kind   BlobType          // Block, append or page, fixed at creation
+	window []byte            // Contents read ahead from the remote
+	winOff int64             // Offset of window within the blob
+	dirty  bool              // Does body hold writes not yet uploaded?
+	unsent int64             // Bytes written since the last upload
+	spans  [][2]int64        // Byte ranges written since the last upload
+	blocks []BlockInfo       // Committed blocks of the remote, nil if unknown
+	idle   *time.Timer       // Commits dirty contents once writes go quiet
+	lost   error             // Conflict an idle commit dropped writes on, for the next flush to report
+	wmu    sync.Mutex        // Guards everything above, against idle commits and concurrent sessions
+	fresh  *BlobInfo         // Properties from a listing, for the next holder of wmu to take in
+	known  time.Time         // When size and etag were last taken from the remote by us, listings asked for before are stale
+	mu     sync.Mutex        // Guards fresh and known, and size, etag, kind and dirty for readers not holding wmu, writers hold both
+	store  Backend           // Storage the blob lives in
 }
 
-// List remote Azure blobs by name
-func ListBlobs(srv *Server) ([]string, error) {
-	names := make([]string, 0, maxBlobs)
+// Create a new blob
+func NewBlob(file *File, store Backend) *Blob {
+	return &Blob{
+		file:  file,
+		last:  time.Now(),
+		kind:  BlockBlob,
+		store: store,
+	}
+}
 
-	for marker := (azblob.Marker{}); marker.NotDone(); {
-		blob, err := srv.container.ListBlobsFlatSegment(srv.ctx, marker, azblob.ListBlobsSegmentOptions{})
-		if err != nil {
-			return nil, errors.New("could not list blobs from container - " + err.Error())
+// Name of the blob in the backend, the file path without the leading `/`
+func (b *Blob) key() string {
+	return strings.TrimPrefix(b.file.Path(), "/")
+}
+
+// Modification time of a blob, a client chosen time in metadata wins over the backend's
+func modTime(info BlobInfo) time.Time {
+	if s, ok := info.Metadata[mtimeKey]; ok {
+		secs, err := strconv.ParseInt(s, 10, 64)
+		if err == nil {
+			return time.Unix(secs, 0)
 		}
+	}
 
-		// Shift forwards to the next marker in the set of blobs
-		marker = blob.NextMarker
+	return info.LastModified
+}
+
+// Record the properties of the remote blob, from a listing or upload - caller holds wmu
+// They supersede any listed while wmu was held
+func (b *Blob) setInfo(info BlobInfo) {
+	b.mu.Lock()
+	b.size = info.Size
+	b.etag = info.ETag
+	b.known = time.Now()
+	if info.Type != "" {
+		b.kind = info.Type
+	}
+	b.fresh = nil
+	b.mu.Unlock()
 
-		for _, info := range blob.Segment.BlobItems {
-			names = append(names, info.Name)
+	if info.ContentType != "" {
+		b.ctype = info.ContentType
+	}
+	if info.Metadata != nil {
+		b.meta = info.Metadata
+	}
+
+	b.file.setLast(modTime(info))
+	b.window = nil
+	b.blocks = nil
+}
+
+// Properties an upload of the contents keeps - caller holds wmu
+// The client chosen modification time lapses, the upload is the newer change
+func (b *Blob) rewrite() BlobProps {
+	meta := make(map[string]string, len(b.meta))
+	for k, v := range b.meta {
+		if k != mtimeKey {
+			meta[k] = v
 		}
 	}
 
-	return names, nil
+	return BlobProps{ContentType: b.ctype, Metadata: meta}
 }
 
-// Create a new blob
-func NewBlob(name *string, container azblob.ContainerURL) *Blob {
-	url := container.NewBlockBlobURL(*name)
+// Take in properties from a listing asked for at listed, dropping contents only if the remote changed
+// Unsent writes are kept, their upload will report the conflict
+// A listing asked for before our own last upload or download may predate it and is ignored
+// Listings never wait on I/O, the next holder of wmu drops the contents
+func (b *Blob) update(info BlobInfo, listed time.Time) {
+	mtime := b.file.ModTime()
 
-	return &Blob{
-		name: name,
-		last: time.Now(),
-		url:  url,
+	b.mu.Lock()
+	etag := b.etag
+	if b.fresh != nil {
+		etag = b.fresh.ETag
 	}
+	if b.dirty || b.known.After(listed) || (info.ETag == etag && modTime(info).Equal(mtime)) {
+		b.mu.Unlock()
+		return
+	}
+	b.fresh = &info
+	b.mu.Unlock()
+
+	b.file.setLast(modTime(info))
+}
+
+// Take wmu, along with any properties listed since it was last held
+func (b *Blob) lock() {
+	b.wmu.Lock()
+
+	b.mu.Lock()
+	fresh := b.fresh
+	b.mu.Unlock()
+
+	if fresh != nil {
+		b.setInfo(*fresh)
+		b.loaded = false
+		b.body.Reset()
+	}
+}
+
+// Release wmu
+func (b *Blob) unlock() {
+	b.wmu.Unlock()
+}
+
+// Size and type as last listed or written, without waiting on I/O in progress
+func (b *Blob) props() (int64, BlobType) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fresh != nil {
+		kind := b.kind
+		if b.fresh.Type != "" {
+			kind = b.fresh.Type
+		}
+
+		return b.fresh.Size, kind
+	}
+
+	return b.size, b.kind
+}
+
+// Does the body hold writes not yet uploaded? Answers without waiting on I/O in progress
+func (b *Blob) isDirty() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.dirty
+}
+
+// Download the contents if we have not already
+func (b *Blob) load(ctx context.Context) error {
+	if b.loaded {
+		return nil
+	}
+
+	return b.Download(ctx)
 }
 
 // Return the contents of the body buffer
-func (b Blob) Contents() []byte {
-	// TODO - sync with Azure to verify state?
+func (b *Blob) Contents() []byte {
+	// TODO - sync with the backend to verify state?
 	return b.body.Bytes()
 }
 
 // Upload a blob in full
+// Only block blobs are uploaded whole, anything else would be replaced by a block blob
 func (b *Blob) Upload(ctx context.Context) error {
-	log.Println("!!!! UPLOADING ", *b.name)
-	opts := azblob.UploadStreamToBlockBlobOptions{
-		BufferSize: bufSize,
-		MaxBuffers: maxBuffers,
+	if b.kind != BlockBlob {
+		return ErrBlobType
+	}
+
+	log.Println("!!!! UPLOADING ", b.key())
+
+	info, err := b.store.Put(ctx, b.key(), b.body.Bytes(), b.rewrite(), b.etag)
+	if err != nil {
+		return err
+	}
+
+	b.loaded = true
+	b.setInfo(info)
+
+	return nil
+}
+
+// Note n bytes written to the body at off, they are uploaded by Flush
+func (b *Blob) dirtied(off int64, n int) {
+	b.mu.Lock()
+	b.dirty = true
+	b.size = int64(b.body.Len())
+	b.fresh = nil
+	b.mu.Unlock()
+
+	b.unsent += int64(n)
+	b.window = nil
+
+	// Sequential writes extend the last span
+	end := off + int64(n)
+	if last := len(b.spans) - 1; last >= 0 && b.spans[last][1] == off {
+		b.spans[last][1] = end
+		return
+	}
+
+	b.spans = append(b.spans, [2]int64{off, end})
+}
+
+// Were any bytes in [start, end) written since the last upload?
+func (b *Blob) touched(start, end int64) bool {
+	for _, span := range b.spans {
+		if span[0] < end && span[1] > start {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A fresh, random block ID
+func newBlockID() string {
+	id := make([]byte, blockIDLen)
+	rand.Read(id)
+
+	return base64.StdEncoding.EncodeToString(id)
+}
+
+// Upload the body as blocks of at most size bytes, restaging only blocks covering written bytes
+// Untouched committed blocks are listed again by ID
+func (b *Blob) putBlocks(ctx context.Context, store BlockBackend, size int64) error {
+	if b.blocks == nil {
+		blocks, err := store.Blocks(ctx, b.key())
+		if err != nil {
+			return err
+		}
+
+		b.blocks = blocks
 	}
 
-	_, err := azblob.UploadStreamToBlockBlob(ctx, bytes.NewReader(b.body.Bytes()), b.url, opts)
+	data := b.body.Bytes()
+	end := int64(len(data))
+	idLen := len(newBlockID())
 
-	return err
+	// Every block ID of a blob must be the same length, blocks from other writers may not match ours
+	reuse := true
+	for _, block := range b.blocks {
+		if len(block.ID) != idLen {
+			reuse = false
+		}
+	}
+
+	var (
+		ids     []string
+		blocks  []BlockInfo
+		staging = make(map[string][2]int64) // Byte range of each new block
+		from    = int64(-1)                 // Start of bytes needing new blocks
+	)
+
+	// Cut [from, to) into new blocks
+	restage := func(to int64) {
+		for ; from < to; from += size {
+			n := size
+			if from+n > to {
+				n = to - from
+			}
+
+			id := newBlockID()
+			ids = append(ids, id)
+			blocks = append(blocks, BlockInfo{ID: id, Size: n})
+			staging[id] = [2]int64{from, from + n}
+		}
+
+		from = -1
+	}
+
+	var off int64
+	for _, block := range b.blocks {
+		start, stop := off, off+block.Size
+		off = stop
+
+		if reuse && stop <= end && !b.touched(start, stop) {
+			if from >= 0 {
+				restage(start)
+			}
+
+			ids = append(ids, block.ID)
+			blocks = append(blocks, block)
+			continue
+		}
+
+		if from < 0 && start < end {
+			from = start
+		}
+	}
+
+	// Whatever lies past the committed blocks is new
+	if from < 0 && off < end {
+		from = off
+	}
+	if from >= 0 {
+		restage(end)
+	}
+
+	news := make([]string, 0, len(staging))
+	for id := range staging {
+		news = append(news, id)
+	}
+
+	log.Println("!!!! STAGING", b.key(), len(news), "of", len(ids), "blocks")
+	err := batch(news, func(id string) error {
+		r := staging[id]
+		return store.StageBlock(ctx, b.key(), id, data[r[0]:r[1]])
+	})
+	if err != nil {
+		return err
+	}
+
+	info, err := store.CommitBlocks(ctx, b.key(), ids, b.rewrite(), b.etag)
+	if err != nil {
+		return err
+	}
+
+	b.loaded = true
+	info.Size = end
+	b.setInfo(info)
+	b.blocks = blocks
+
+	return nil
+}
+
+// Upload the contents if they hold unsent writes - caller holds wmu
+func (b *Blob) commit(ctx context.Context) error {
+	if b.idle != nil {
+		b.idle.Stop()
+		b.idle = nil
+	}
+
+	if !b.dirty {
+		return nil
+	}
+
+	// Send only changed blocks where the backend allows it
+	var err error
+	store, ok := b.store.(BlockBackend)
+	size := b.file.srv.blockSize
+	if ok && size > 0 {
+		err = b.putBlocks(ctx, store, size)
+	} else {
+		err = b.Upload(ctx)
+	}
+	if errors.Is(err, ErrConflict) {
+		// Retrying can never succeed, the writes are dropped and the remote taken in instead
+		log.Println("!!!! DROPPING WRITES", b.key(), err)
+		b.reset(ctx)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.dirty = false
+	b.mu.Unlock()
+
+	b.unsent = 0
+	b.spans = nil
+
+	return nil
+}
+
+// Upload any unsent writes
+// Once an idle commit has dropped writes nothing more is sent, the conflict is reported until the file is closed
+func (b *Blob) Flush(ctx context.Context) error {
+	b.lock()
+	defer b.unlock()
+
+	if b.lost != nil {
+		return b.lost
+	}
+
+	return b.commit(ctx)
+}
+
+// Upload any unsent writes as the file is closed, reporting writes an idle commit dropped for the last time
+func (b *Blob) Close(ctx context.Context) error {
+	b.lock()
+	defer b.unlock()
+
+	if b.lost != nil {
+		err := b.lost
+		b.lost = nil
+		return err
+	}
+
+	return b.commit(ctx)
+}
+
+// Flush once no writes have arrived for d - caller holds wmu
+func (b *Blob) flushAfter(ctx context.Context, d time.Duration) {
+	if b.idle != nil {
+		b.idle.Stop()
+	}
+
+	b.idle = time.AfterFunc(d, func() {
+		b.lock()
+		defer b.unlock()
+
+		err := b.commit(ctx)
+		if errors.Is(err, ErrConflict) {
+			// Dropped, later writes would land on their contents, they fail until the file is closed
+			b.lost = err
+		} else if err != nil {
+			// Still dirty, the next clunk or fsync retries and reports it
+			log.Println("!!!! IDLE FLUSH FAILED", b.key(), err)
+		}
+	})
+}
+
+// Drop unsent writes, the blob is going away
+// Should it stay after all, its remote contents and properties are taken in again
+func (b *Blob) discard(ctx context.Context) {
+	b.lock()
+	defer b.unlock()
+
+	if !b.dirty {
+		b.drop()
+		return
+	}
+
+	b.reset(ctx)
+}
+
+// Forget unsent writes and the contents they were made to, reads fetch the remote again - caller holds wmu
+func (b *Blob) drop() {
+	if b.idle != nil {
+		b.idle.Stop()
+		b.idle = nil
+	}
+
+	b.mu.Lock()
+	b.dirty = false
+	b.mu.Unlock()
+
+	b.unsent = 0
+	b.spans = nil
+	b.body.Reset()
+	b.loaded = false
+	b.window = nil
+}
+
+// Drop unsent writes and take in the properties of the remote as it is now - caller holds wmu
+func (b *Blob) reset(ctx context.Context) {
+	b.drop()
+
+	info, err := b.store.Stat(ctx, b.key())
+	if err != nil {
+		log.Println("!!!! could not stat", b.key(), "- ", err)
+		return
+	}
+
+	b.setInfo(info)
+}
+
+// Create the blob remotely, empty, as a blob of type kind
+// An existing blob is left alone, whoever wrote it since we last listed, failing with os.ErrExist
+func (b *Blob) Create(ctx context.Context, kind BlobType) error {
+	b.lock()
+	defer b.unlock()
+
+	var info BlobInfo
+	var err error
+
+	switch kind {
+	case AppendBlob:
+		store, ok := b.store.(AppendBackend)
+		if !ok {
+			return errors.New("backend does not support append blobs")
+		}
+
+		log.Println("!!!! CREATING APPEND", b.key())
+		info, err = store.CreateAppend(ctx, b.key(), IfAbsent)
+
+	case PageBlob:
+		store, ok := b.store.(PageBackend)
+		if !ok {
+			return errors.New("backend does not support page blobs")
+		}
+
+		log.Println("!!!! CREATING PAGES", b.key())
+		info, err = store.CreatePages(ctx, b.key(), 0, IfAbsent)
+
+	default:
+		log.Println("!!!! CREATING", b.key())
+		info, err = b.store.Put(ctx, b.key(), nil, BlobProps{}, IfAbsent)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	b.body.Reset()
+	b.loaded = true
+	info.Size = 0
+	info.Type = kind
+	b.setInfo(info)
+
+	return nil
+}
+
+// Record properties after writing straight to the remote, which left the blob size bytes long
+func (b *Blob) wrote(info BlobInfo, size int64) {
+	info.Size = size
+	b.setInfo(info)
+
+	// Our copy of the contents is stale, reads fetch ranges instead
+	b.loaded = false
+	b.body.Reset()
+}
+
+// Write p to the end of an append blob, wherever others have left it
+// As for DMAPPEND files, the offset asked for is ignored
+func (b *Blob) Append(ctx context.Context, p []byte) (int, error) {
+	store, ok := b.store.(AppendBackend)
+	if !ok {
+		return 0, errors.New("backend does not support append blobs")
+	}
+
+	log.Println("!!!! APPENDING", b.key(), len(p))
+
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > maxPut {
+			chunk = chunk[:maxPut]
+		}
+
+		info, err := store.Append(ctx, b.key(), chunk)
+		if err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b.wrote(info, info.Size)
+	}
+
+	return n, nil
+}
+
+// Write p to a page blob at off, growing it as needed
+// Partial pages are read and written back whole, pages of zeros are cleared rather than sent
+func (b *Blob) WritePages(ctx context.Context, p []byte, off int64) (int, error) {
+	store, ok := b.store.(PageBackend)
+	if !ok {
+		return 0, errors.New("backend does not support page blobs")
+	}
+
+	if off%pageSize != 0 || len(p)%pageSize != 0 {
+		return b.patchPages(ctx, store, p, off)
+	}
+
+	log.Println("!!!! WRITING PAGES", b.key(), off, len(p))
+
+	end := off + int64(len(p))
+	if end > b.size {
+		info, err := store.ResizePages(ctx, b.key(), end, b.etag)
+		if err != nil {
+			return 0, err
+		}
+
+		b.wrote(info, end)
+	}
+
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > maxPut {
+			chunk = chunk[:maxPut]
+		}
+
+		var (
+			info BlobInfo
+			err  error
+		)
+
+		at := off + int64(n)
+		if isZero(chunk) {
+			info, err = store.ClearPages(ctx, b.key(), at, int64(len(chunk)), b.etag)
+		} else {
+			info, err = store.PutPages(ctx, b.key(), at, chunk, b.etag)
+		}
+		if err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b.wrote(info, b.size)
+	}
+
+	return n, nil
+}
+
+// Write p at off by rewriting the whole pages around it
+func (b *Blob) patchPages(ctx context.Context, store PageBackend, p []byte, off int64) (int, error) {
+	start := off - off%pageSize
+	end := off + int64(len(p))
+	if end%pageSize != 0 {
+		end += pageSize - end%pageSize
+	}
+
+	log.Println("!!!! PATCHING PAGES", b.key(), start, end)
+
+	// Bytes past the end of the blob are zeros once it grows
+	pages := make([]byte, end-start)
+	if start < b.size {
+		data, _, err := store.Get(ctx, b.key(), start, end-start)
+		if err != nil {
+			return 0, err
+		}
+
+		copy(pages, data)
+	}
+
+	copy(pages[off-start:], p)
+
+	_, err := b.WritePages(ctx, pages, start)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Resize a page blob, size must be whole pages
+func (b *Blob) ResizePages(ctx context.Context, size int64) error {
+	store, ok := b.store.(PageBackend)
+	if !ok {
+		return errors.New("backend does not support page blobs")
+	}
+
+	if size%pageSize != 0 {
+		return ErrPageSize
+	}
+
+	log.Println("!!!! RESIZING PAGES", b.key(), size)
+	info, err := store.ResizePages(ctx, b.key(), size, b.etag)
+	if err != nil {
+		return err
+	}
+
+	b.wrote(info, size)
+
+	return nil
 }
 
 // Download a blob in full
 func (b *Blob) Download(ctx context.Context) error {
-	log.Println("!!!! DOWNLOADING", *b.name)
-	resp, err := b.url.Download(ctx, int64(0), int64(azblob.CountToEnd), azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
-
-	opts := azblob.RetryReaderOptions{
-		MaxRetryRequests: maxRetry,
+	log.Println("!!!! DOWNLOADING", b.key())
+	data, etag, err := b.store.Get(ctx, b.key(), 0, -1)
+	if err != nil {
+		return err
 	}
 
-	bodyStream := resp.Body(opts)
 	b.body.Reset()
+	_, err = b.body.Write(data)
+	if err != nil {
+		return err
+	}
+
+	b.loaded = true
+	b.mu.Lock()
+	b.size = int64(len(data))
+	b.etag = etag
+	b.known = time.Now()
+	b.mu.Unlock()
+	b.window = nil
+
+	return nil
+}
+
+// Read into p from off, fetching ranges from the remote and reading ahead by ahead bytes
+// With a disk cache, whole chunks are fetched and kept instead
+func (b *Blob) ReadRange(ctx context.Context, p []byte, off, ahead int64) (int, error) {
+	if cache := b.file.srv.cache; cache != nil {
+		return b.readCached(ctx, cache, p, off)
+	}
+
+	end := off + int64(len(p))
+	winEnd := b.winOff + int64(len(b.window))
+
+	// The window is good if it covers the request, or everything up to end of file
+	if b.window == nil || off < b.winOff || off >= winEnd || (end > winEnd && winEnd < b.size) {
+		count := int64(len(p))
+		if ahead > count {
+			count = ahead
+		}
+
+		log.Println("!!!! FETCHING", b.key(), off, count)
+		data, _, err := b.store.Get(ctx, b.key(), off, count)
+		if err != nil {
+			return 0, err
+		}
+
+		b.window = data
+		b.winOff = off
+	}
+
+	n := copy(p, b.window[off-b.winOff:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Read into p from off a chunk at a time through the disk cache
+func (b *Blob) readCached(ctx context.Context, cache *Cache, p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off+int64(n) < b.size {
+		pos := off + int64(n)
+		i := pos / cacheChunk
+
+		data, err := b.chunk(ctx, cache, i)
+		if err != nil {
+			return n, err
+		}
+
+		// A chunk cut short means the blob shrank under us
+		at := pos - i*cacheChunk
+		if at >= int64(len(data)) {
+			break
+		}
+
+		n += copy(p[n:], data[at:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Chunk i of the contents, from the disk cache or fetched and kept there
+func (b *Blob) chunk(ctx context.Context, cache *Cache, i int64) ([]byte, error) {
+	key := b.key()
+	data, ok := cache.Get(key, b.etag, i)
+	if ok {
+		return data, nil
+	}
+
+	log.Println("!!!! FETCHING", key, "chunk", i)
+	data, etag, err := b.store.Get(ctx, key, i*cacheChunk, cacheChunk)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only contents of the version we know of are kept
+	if etag != "" && etag == b.etag {
+		cache.Put(key, etag, i, data)
+	}
+
+	return data, nil
+}
+
+// Upload the zero-byte `dir/` marker which keeps an empty directory in existence
+func (b *Blob) Mark(ctx context.Context) error {
+	log.Println("!!!! MARKING", b.key()+"/")
+
+	info, err := b.store.Put(ctx, b.key()+"/", nil, BlobProps{}, "")
+	if err != nil {
+		return err
+	}
+
+	b.file.setLast(modTime(info))
+
+	return nil
+}
+
+// Store a client chosen modification time in the blob's metadata
+func (b *Blob) SetModTime(ctx context.Context, mtime time.Time) error {
+	log.Println("!!!! SETTING MTIME", b.key(), mtime)
+
+	b.lock()
+	defer b.unlock()
+
+	// Metadata is replaced wholesale, keep what others have stored
+	info, err := b.store.Stat(ctx, b.key())
+	if err != nil {
+		return err
+	}
+
+	meta := make(map[string]string)
+	for k, v := range info.Metadata {
+		meta[k] = v
+	}
+	meta[mtimeKey] = strconv.FormatInt(mtime.Unix(), 10)
+
+	updated, err := b.store.SetMetadata(ctx, b.key(), meta, info.ETag)
+	if err != nil {
+		return err
+	}
+
+	// Contents we hold are no less current for the new ETag
+	if b.etag == info.ETag {
+		b.mu.Lock()
+		b.etag = updated.ETag
+		b.known = time.Now()
+		b.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Delete a blob from the backend, unless it changed since we last saw it
+// Unsent writes go with it, in the same hold of the lock so no idle commit can bring it back
+func (b *Blob) Delete(ctx context.Context) error {
+	log.Println("!!!! DELETING", b.key())
+
+	b.lock()
+	defer b.unlock()
+
+	err := b.store.Delete(ctx, b.key(), b.etag)
+	if err != nil {
+		// Unsent writes stay, the blob does too
+		return err
+	}
 
-	// Read the body into a buffer
-	_, err = b.body.ReadFrom(bodyStream)
+	b.drop()
 
-	return err
+	return nil
 }
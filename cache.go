@@ -0,0 +1,219 @@
+// Copyright (c) 2020 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// On-disk cache of blob contents in chunks, kept across restarts
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheChunk = 1024 * 1024 // Bytes of a blob held in each cache file
+	cacheTemp  = ".tmp"      // Suffix of cache files still being written
+)
+
+// Chunks of blob contents kept as files in a directory, evicted least recently used first
+// A chunk is keyed by blob name and ETag, so a changed blob never hits stale contents
+type Cache struct {
+	sync.Mutex
+	dir     string
+	maxSize int64         // Total bytes kept, 0 for no limit
+	maxAge  time.Duration // Time since last use after which a chunk goes, 0 for no limit
+	size    int64         // Total bytes held
+	lru     *list.List    // Chunks, most recently used at the front
+	entries map[string]*list.Element
+}
+
+// A cached chunk, by the name of its file
+type cacheEntry struct {
+	file string
+	size int64
+	used time.Time
+}
+
+// Open the cache in dir, creating it if needed and taking in chunks left by earlier runs
+func OpenCache(dir string, maxSize int64, maxAge time.Duration) (*Cache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The modification time of a chunk file is when it was last used
+	found := make([]*cacheEntry, 0, len(infos))
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		// Files of anyone else sharing the directory are left alone
+		if strings.HasSuffix(info.Name(), cacheTemp) && isCacheFile(strings.TrimSuffix(info.Name(), cacheTemp)) {
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		if !isCacheFile(info.Name()) {
+			continue
+		}
+
+		found = append(found, &cacheEntry{file: info.Name(), size: info.Size(), used: info.ModTime()})
+	}
+
+	// Oldest first, so the front ends up most recently used
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].used.Before(found[j].used)
+	})
+	for _, entry := range found {
+		c.insert(entry)
+	}
+
+	c.Lock()
+	c.evict()
+	c.Unlock()
+
+	return c, nil
+}
+
+// Name of the file holding chunk i of a blob version
+func cacheFile(name, etag string, i int64) string {
+	sum := sha256.Sum256([]byte(name + "\n" + etag))
+	return hex.EncodeToString(sum[:]) + "." + strconv.FormatInt(i, 10)
+}
+
+// Is file named as cacheFile names chunks, a SHA-256 in hex then the chunk index?
+func isCacheFile(file string) bool {
+	i := strings.LastIndex(file, ".")
+	if i != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(file[:i])
+	if err != nil {
+		return false
+	}
+
+	n, err := strconv.ParseInt(file[i+1:], 10, 64)
+	return err == nil && n >= 0 && strconv.FormatInt(n, 10) == file[i+1:]
+}
+
+// Add an entry as the most recently used, replacing any of the file - caller holds the lock
+func (c *Cache) insert(entry *cacheEntry) {
+	if e, ok := c.entries[entry.file]; ok {
+		c.size -= c.lru.Remove(e).(*cacheEntry).size
+	}
+
+	c.entries[entry.file] = c.lru.PushFront(entry)
+	c.size += entry.size
+}
+
+// Forget an entry and delete its file - caller holds the lock
+func (c *Cache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.file)
+	c.size -= entry.size
+
+	err := os.Remove(filepath.Join(c.dir, entry.file))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("!!!! could not remove cache file - ", err)
+	}
+}
+
+// Drop chunks past the age limit, then the least recently used until under the size limit - caller holds the lock
+func (c *Cache) evict() {
+	for e := c.lru.Back(); e != nil; e = c.lru.Back() {
+		entry := e.Value.(*cacheEntry)
+		old := c.maxAge > 0 && time.Since(entry.used) > c.maxAge
+		big := c.maxSize > 0 && c.size > c.maxSize
+		if !old && !big {
+			return
+		}
+
+		c.remove(e)
+	}
+}
+
+// Chunk i of a blob version, if held
+func (c *Cache) Get(name, etag string, i int64) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	file := cacheFile(name, etag, i)
+	e, ok := c.entries[file]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if c.maxAge > 0 && time.Since(entry.used) > c.maxAge {
+		c.remove(e)
+		return nil, false
+	}
+
+	full := filepath.Join(c.dir, file)
+	data, err := ioutil.ReadFile(full)
+	if err != nil || int64(len(data)) != entry.size {
+		c.remove(e)
+		return nil, false
+	}
+
+	// Kept on disk so the order survives a restart
+	entry.used = time.Now()
+	os.Chtimes(full, entry.used, entry.used)
+	c.lru.MoveToFront(e)
+
+	return data, true
+}
+
+// Keep chunk i of a blob version, evicting others to make room
+func (c *Cache) Put(name, etag string, i int64, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	file := cacheFile(name, etag, i)
+	full := filepath.Join(c.dir, file)
+
+	// Written aside and renamed into place, a crash never leaves a partial chunk
+	err := ioutil.WriteFile(full+cacheTemp, data, 0600)
+	if err == nil {
+		err = os.Rename(full+cacheTemp, full)
+	}
+	if err != nil {
+		log.Println("!!!! could not write cache file - ", err)
+		os.Remove(full + cacheTemp)
+		return
+	}
+
+	c.insert(&cacheEntry{file: file, size: int64(len(data)), used: time.Now()})
+	c.evict()
+}
+
+// Total bytes held
+func (c *Cache) Size() int64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.size
+}
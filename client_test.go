@@ -0,0 +1,598 @@
+// Copyright (c) 2020 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Test harness - serves a Server over loopback and drives it with a small 9p client
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"aqwari.net/net/styx"
+	"aqwari.net/net/styx/styxproto"
+)
+
+const (
+	testMsize = 8192 // Message size negotiated by the test client
+	rootFid   = 0    // Fid the test client attaches to the root with
+)
+
+// Silence the chatty server logging unless tests are run verbose
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	os.Exit(m.Run())
+}
+
+// Create a Server over store with its tree populated
+func newServer(t *testing.T, store Backend) *Server {
+	t.Helper()
+
+	srv := &Server{
+		backend: store,
+		ctx:     context.Background(),
+	}
+	srv.Initialize()
+
+	if err := srv.File.Populate(); err != nil {
+		t.Fatal("could not populate tree - ", err)
+	}
+
+	return srv
+}
+
+// A loopback listener, closed once the test ends
+func loopback(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not listen on loopback - ", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+// Serve srv on a loopback listener, returns the address
+func listen(t *testing.T, srv *Server) string {
+	t.Helper()
+
+	l := loopback(t)
+	styxServer := styx.Server{Handler: srv}
+	go styxServer.Serve(l)
+
+	return l.Addr().String()
+}
+
+// Serve srv as listen does, for tests sending Twstat - See: orderedListener
+func listenOrdered(t *testing.T, srv *Server) string {
+	t.Helper()
+
+	l := loopback(t)
+	styxServer := styx.Server{Handler: srv}
+	go styxServer.Serve(orderedListener{l})
+
+	return l.Addr().String()
+}
+
+// A listener whose connections order each read after the writes before it
+// styx reads a Twstat's tag after sending its reply, from a buffer the next read refills
+// The client waits on that reply first, but the race detector cannot see through the socket
+// Only tests sending Twstat use it, so races in our own handlers stay visible to the rest
+type orderedListener struct {
+	net.Listener
+}
+
+func (l orderedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &orderedConn{Conn: conn}, nil
+}
+
+type orderedConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *orderedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.mu.Unlock()
+
+	return c.Conn.Write(p)
+}
+
+// Read into a buffer of our own, p is only filled once ordered after the writes
+func (c *orderedConn) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	n, err := c.Conn.Read(buf)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return copy(p, buf[:n]), err
+}
+
+// Start a Server over store on a loopback listener, returns the address
+func serve(t *testing.T, store Backend) (*Server, string) {
+	t.Helper()
+
+	srv := newServer(t, store)
+
+	return srv, listen(t, srv)
+}
+
+// Start a Server as serve does, for tests sending Twstat - See: orderedListener
+func serveOrdered(t *testing.T, store Backend) (*Server, string) {
+	t.Helper()
+
+	srv := newServer(t, store)
+
+	return srv, listenOrdered(t, srv)
+}
+
+// A synchronous 9p client, one request in flight at a time
+type client struct {
+	t     *testing.T
+	conn  net.Conn
+	enc   *styxproto.Encoder
+	dec   *styxproto.Decoder
+	msize int64
+	fid   uint32 // Last fid handed out
+}
+
+// Dial a test server and attach to its root as rootFid
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("could not dial test server - ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &client{
+		t:    t,
+		conn: conn,
+		enc:  styxproto.NewEncoder(conn),
+		dec:  styxproto.NewDecoder(conn),
+	}
+
+	c.enc.Tversion(testMsize, "9P2000")
+	switch m := c.recv().(type) {
+	case styxproto.Rversion:
+		c.msize = m.Msize()
+	default:
+		t.Fatalf("unexpected version response %v", m)
+	}
+
+	c.enc.Tattach(1, rootFid, styxproto.NoFid, "test", "")
+	if _, err := c.reply(); err != nil {
+		t.Fatal("could not attach - ", err)
+	}
+
+	return c
+}
+
+// Flush pending requests and read the next message
+func (c *client) recv() styxproto.Msg {
+	c.t.Helper()
+
+	if err := c.enc.Flush(); err != nil {
+		c.t.Fatal("could not send request - ", err)
+	}
+
+	if !c.dec.Next() {
+		c.t.Fatal("could not read response - ", c.dec.Err())
+	}
+
+	return c.dec.Msg()
+}
+
+// Read the next message, converting an Rerror into an error
+func (c *client) reply() (styxproto.Msg, error) {
+	c.t.Helper()
+
+	msg := c.recv()
+	if e, ok := msg.(styxproto.Rerror); ok {
+		return nil, errors.New(string(e.Ename()))
+	}
+
+	return msg, nil
+}
+
+// Hand out a fresh fid
+func (c *client) newfid() uint32 {
+	c.fid++
+	return c.fid
+}
+
+// Walk from the root to a slash-separated path, returning a new fid
+func (c *client) walk(full string) (uint32, error) {
+	c.t.Helper()
+
+	var names []string
+	for _, name := range strings.Split(full, "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	fid := c.newfid()
+	if err := c.enc.Twalk(1, rootFid, fid, names...); err != nil {
+		c.t.Fatal("could not encode walk - ", err)
+	}
+
+	msg, err := c.reply()
+	if err != nil {
+		return 0, err
+	}
+
+	// A partial walk leaves the new fid unassigned
+	if w, ok := msg.(styxproto.Rwalk); ok && w.Nwqid() != len(names) {
+		return 0, errors.New("No such file or directory")
+	}
+
+	return fid, nil
+}
+
+// Open a walked fid for I/O
+func (c *client) open(fid uint32, mode uint8) error {
+	c.t.Helper()
+
+	c.enc.Topen(1, fid, mode)
+	_, err := c.reply()
+
+	return err
+}
+
+// Create name inside the directory fid, fid then refers to the new file
+func (c *client) create(fid uint32, name string, perm uint32, mode uint8) error {
+	c.t.Helper()
+
+	c.enc.Tcreate(1, fid, name, perm, mode)
+	_, err := c.reply()
+
+	return err
+}
+
+// Read an open fid from offset until the end of file
+func (c *client) read(fid uint32, offset int64) ([]byte, error) {
+	c.t.Helper()
+
+	var out []byte
+	for {
+		if err := c.enc.Tread(1, fid, offset, c.msize-styxproto.IOHeaderSize); err != nil {
+			c.t.Fatal("could not encode read - ", err)
+		}
+
+		msg, err := c.reply()
+		if err != nil {
+			return out, err
+		}
+
+		data, err := ioutil.ReadAll(msg.(styxproto.Rread))
+		if err != nil {
+			c.t.Fatal("could not read data - ", err)
+		}
+
+		if len(data) == 0 {
+			return out, nil
+		}
+
+		out = append(out, data...)
+		offset += int64(len(data))
+	}
+}
+
+// Read at most count bytes of an open fid at offset, in a single request
+func (c *client) readAt(fid uint32, offset, count int64) ([]byte, error) {
+	c.t.Helper()
+
+	if err := c.enc.Tread(1, fid, offset, count); err != nil {
+		c.t.Fatal("could not encode read - ", err)
+	}
+
+	msg, err := c.reply()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(msg.(styxproto.Rread))
+	if err != nil {
+		c.t.Fatal("could not read data - ", err)
+	}
+
+	return data, nil
+}
+
+// Write data to an open fid at offset, splitting it to fit the message size
+func (c *client) write(fid uint32, offset int64, data []byte) error {
+	c.t.Helper()
+
+	max := int(c.msize - styxproto.IOHeaderSize)
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+
+		if _, err := c.enc.Twrite(1, fid, offset, chunk); err != nil {
+			c.t.Fatal("could not encode write - ", err)
+		}
+
+		if _, err := c.reply(); err != nil {
+			return err
+		}
+
+		data = data[len(chunk):]
+		offset += int64(len(chunk))
+	}
+
+	return nil
+}
+
+// Release a fid
+func (c *client) clunk(fid uint32) error {
+	c.t.Helper()
+
+	c.enc.Tclunk(1, fid)
+	_, err := c.reply()
+
+	return err
+}
+
+// Remove the file a fid refers to, the fid is released either way
+func (c *client) remove(fid uint32) error {
+	c.t.Helper()
+
+	c.enc.Tremove(1, fid)
+	_, err := c.reply()
+
+	return err
+}
+
+// Stat the file a fid refers to
+func (c *client) stat(fid uint32) (styxproto.Stat, error) {
+	c.t.Helper()
+
+	c.enc.Tstat(1, fid)
+	msg, err := c.reply()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only valid until the next message, keep a copy
+	stat := msg.(styxproto.Rstat).Stat()
+
+	return append(styxproto.Stat(nil), stat...), nil
+}
+
+// Change file attributes - see nullStat() for building the argument
+func (c *client) wstat(fid uint32, stat styxproto.Stat) error {
+	c.t.Helper()
+
+	c.enc.Twstat(1, fid, stat)
+	_, err := c.reply()
+
+	return err
+}
+
+// A stat whose fields are all "don't touch" values, bar name
+func nullStat(t *testing.T, name string) styxproto.Stat {
+	t.Helper()
+
+	buf := make([]byte, styxproto.MaxStatLen)
+	stat, _, err := styxproto.NewStat(buf, name, "", "", "")
+	if err != nil {
+		t.Fatal("could not build stat - ", err)
+	}
+
+	qid := make([]byte, 13)
+	for i := range qid {
+		qid[i] = 0xff
+	}
+
+	stat.SetType(^uint16(0))
+	stat.SetDev(^uint32(0))
+	stat.SetQid(styxproto.Qid(qid))
+	stat.SetMode(^uint32(0))
+	stat.SetAtime(^uint32(0))
+	stat.SetMtime(^uint32(0))
+	stat.SetLength(-1)
+
+	return stat
+}
+
+/* Path based conveniences built on the calls above */
+
+// Read the whole of a file by path
+func (c *client) readFile(full string) ([]byte, error) {
+	c.t.Helper()
+
+	fid, err := c.walk(full)
+	if err != nil {
+		return nil, err
+	}
+	defer c.clunk(fid)
+
+	if err := c.open(fid, styxproto.OREAD); err != nil {
+		return nil, err
+	}
+
+	return c.read(fid, 0)
+}
+
+// Create a new file by path and fill it with data
+func (c *client) createFile(full string, data []byte) error {
+	c.t.Helper()
+
+	dir, name := splitPath(full)
+	fid, err := c.walk(dir)
+	if err != nil {
+		return err
+	}
+	defer c.clunk(fid)
+
+	if err := c.create(fid, name, 0666, styxproto.ORDWR); err != nil {
+		return err
+	}
+
+	return c.write(fid, 0, data)
+}
+
+// Create a new directory by path
+func (c *client) mkdir(full string) error {
+	c.t.Helper()
+
+	dir, name := splitPath(full)
+	fid, err := c.walk(dir)
+	if err != nil {
+		return err
+	}
+	defer c.clunk(fid)
+
+	return c.create(fid, name, styxproto.DMDIR|0777, styxproto.OREAD)
+}
+
+// Open an existing file by path and write data at offset
+func (c *client) writeFile(full string, offset int64, data []byte) error {
+	c.t.Helper()
+
+	fid, err := c.walk(full)
+	if err != nil {
+		return err
+	}
+	defer c.clunk(fid)
+
+	if err := c.open(fid, styxproto.OWRITE); err != nil {
+		return err
+	}
+
+	return c.write(fid, offset, data)
+}
+
+// Stat a file by path
+func (c *client) statFile(full string) (styxproto.Stat, error) {
+	c.t.Helper()
+
+	fid, err := c.walk(full)
+	if err != nil {
+		return nil, err
+	}
+	defer c.clunk(fid)
+
+	return c.stat(fid)
+}
+
+// Rename a file by path, name is relative to its directory unless absolute
+func (c *client) rename(full, name string) error {
+	c.t.Helper()
+
+	fid, err := c.walk(full)
+	if err != nil {
+		return err
+	}
+	defer c.clunk(fid)
+
+	return c.wstat(fid, nullStat(c.t, name))
+}
+
+// Set the length of a file by path
+func (c *client) truncate(full string, size int64) error {
+	c.t.Helper()
+
+	fid, err := c.walk(full)
+	if err != nil {
+		return err
+	}
+	defer c.clunk(fid)
+
+	stat := nullStat(c.t, "")
+	stat.SetLength(size)
+
+	return c.wstat(fid, stat)
+}
+
+// Set the modification time of a file by path
+func (c *client) touch(full string, mtime uint32) error {
+	c.t.Helper()
+
+	fid, err := c.walk(full)
+	if err != nil {
+		return err
+	}
+	defer c.clunk(fid)
+
+	stat := nullStat(c.t, "")
+	stat.SetMtime(mtime)
+
+	return c.wstat(fid, stat)
+}
+
+// Remove a file by path
+func (c *client) removeFile(full string) error {
+	c.t.Helper()
+
+	fid, err := c.walk(full)
+	if err != nil {
+		return err
+	}
+
+	return c.remove(fid)
+}
+
+// List the names in a directory by path
+func (c *client) list(full string) ([]string, error) {
+	c.t.Helper()
+
+	data, err := c.readFile(full)
+	if err != nil {
+		return nil, err
+	}
+
+	return statNames(c.t, data), nil
+}
+
+// Names of the stat entries read from a directory
+func statNames(t *testing.T, data []byte) []string {
+	t.Helper()
+
+	var names []string
+	for len(data) >= 2 {
+		n := 2 + int(binary.LittleEndian.Uint16(data))
+		if n > len(data) {
+			t.Fatal("short stat in directory listing")
+		}
+
+		names = append(names, string(styxproto.Stat(data[:n]).Name()))
+		data = data[n:]
+	}
+
+	return names
+}
+
+// Split a slash-separated path into its directory and final element
+func splitPath(full string) (string, string) {
+	i := strings.LastIndex(full, "/")
+	if i < 0 {
+		return "", full
+	}
+
+	return full[:i], full[i+1:]
+}
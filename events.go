@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Applies changes reported by an event source to the file tree, without listing
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	eventRetry = 5 * time.Second // Wait after a failure to fetch events
+)
+
+// A blob created, replaced or deleted by someone else
+type Event struct {
+	Name    string // Blob name, `dir/` for a directory marker
+	Deleted bool   // Was the blob deleted?
+}
+
+// Reports changes to the blobs of the container, such as a change feed or event queue
+type EventSource interface {
+	// Wait for the next changes, returns once some arrive or ctx ends
+	// Changes fetched before a failure may come along with its error
+	Next(ctx context.Context) ([]Event, error)
+}
+
+// Apply changes from src to the tree until the server's context ends
+func (srv *Server) Watch(src EventSource) {
+	for {
+		events, err := src.Next(srv.ctx)
+		if srv.ctx.Err() != nil {
+			return
+		}
+
+		// Events fetched before a failure still count
+		for _, ev := range events {
+			aerr := srv.apply(ev)
+			if aerr != nil {
+				log.Println("!!!! could not apply event for", ev.Name, "- ", aerr)
+			}
+		}
+
+		if err != nil {
+			log.Println("!!!! could not fetch events - ", err)
+			time.Sleep(eventRetry)
+		}
+	}
+}
+
+// Apply a single change
+// Events arrive late and out of order, so the blob's current state is what counts
+func (srv *Server) apply(ev Event) error {
+	full := "/" + strings.TrimSuffix(ev.Name, "/")
+	if full == "/" {
+		return nil
+	}
+
+	isDir := strings.HasSuffix(ev.Name, "/")
+
+	asked := time.Now()
+	info, err := srv.backend.Stat(srv.ctx, ev.Name)
+	if err != nil {
+		// Only a blob known to be gone is taken out of the tree
+		if !ev.Deleted || !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		// Directory markers go, the directory stays while anything is beneath it
+		f, err := srv.File.Search(full)
+		if err != nil || len(f.children()) > 0 || f.pending() {
+			return nil
+		}
+
+		if f.Parent().unlink(f) {
+			f.markGone()
+		}
+
+		return nil
+	}
+
+	parent, err := srv.File.mkdirs(path.Dir(full))
+	if err != nil {
+		return err
+	}
+
+	f, created := parent.syncChild(path.Base(full), isDir, info, asked)
+	if created && isDir && parent.listed() {
+		f.mu.Lock()
+		f.synced = time.Now()
+		f.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Find the directory at full, creating it and any missing parents in the tree
+func (t *File) mkdirs(full string) (*File, error) {
+	f := t
+	for _, name := range strings.Split(strings.Trim(full, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		// New directories within a listed one are known in full, anything else in them will be reported too
+		// Beneath a directory not yet listed, they are listed on first use like any other
+		child, created := f.ensureChild(name, true)
+		if created && f.listed() {
+			child.mu.Lock()
+			child.synced = time.Now()
+			child.mu.Unlock()
+		}
+
+		if !child.dir {
+			return nil, errors.New(`"` + child.Path() + `" is not a directory`)
+		}
+
+		f = child
+	}
+
+	return f, nil
+}
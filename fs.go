@@ -12,26 +12,52 @@ import (
 	"log"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	maxChildren = 32  // Maxmimum number of children a directory can have
-	maxProtoBuf = 256 // Maximum size of the buffer for storing directory contents
-	infoBuf     = 10  // Buffer size for file info
+	removeBatch = 16 // Number of blobs copied or deleted concurrently
 )
 
+var (
+	ErrNotEmpty = errors.New("directory not empty") // Removal of a directory with children
+	ErrNotDir   = errors.New("not a directory")     // A path continues past a file
+)
+
+// A path which could not be resolved within the tree
+// The message is the bare 9p error string, `file does not exist` or `not a directory`
+type LookupError struct {
+	Path string // Path being resolved
+	Err  error  // os.ErrNotExist or ErrNotDir
+}
+
+func (e *LookupError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LookupError) Unwrap() error {
+	return e.Err
+}
+
 // Represents a file in the file system
+// mu guards a node's own fields and is held only briefly, a parent's may be held while taking a child's
+// Blob.wmu guards the contents and may be held while taking mu, never the other way around
+// Blob.mu guards what listings and stats read of a blob, it is never held across I/O or while taking another lock
 type File struct {
 	parent   *File            // Parent directory
 	srv      *Server          // Server we run under (could be global?)
 	name     string           // Name of the file singleton `/f/a` is `a`
 	dir      bool             // Are we a directory?
 	last     time.Time        // Last modified time
+	synced   time.Time        // When the directory was last listed
+	seen     time.Time        // When a listing last reported the file, or it was made here
+	gone     bool             // Deleted remotely, only reachable through fids still holding it
 	*Blob                     // Some kind of contents to the file
-	Children []*File          // Our child nodes (if a dirrectory)
-	info     chan os.FileInfo // Info channel for Readdir()
+	Children map[string]*File // Our child nodes by name (if a dirrectory)
+	mu       sync.RWMutex     // Guards the fields above, bar dir and srv which never change
 }
 
 // Creates a VFile out of a File - See: vfile.go
@@ -45,68 +71,207 @@ func NewTree(srv *Server) *File {
 		srv:      srv,
 		name:     "/",
 		dir:      true,
-		Children: make([]*File, 0, maxChildren),
+		last:     time.Now(),
+		Children: make(map[string]*File),
 	}
 
 	return f
 }
 
-// Synchronize our tree with Azure remote
+// Populate the directory t from the remote
+// Directories beneath are listed on first use, huge containers are never held whole
+func (t *File) Populate() error {
+	return t.Sync()
+}
+
+// Synchronize the directory t if its listing is older than the server's TTL
+func (t *File) Revalidate() error {
+	t.mu.RLock()
+	fresh := time.Since(t.synced) < t.srv.ttl
+	t.mu.RUnlock()
+
+	if !t.dir || fresh {
+		return nil
+	}
+
+	return t.Sync()
+}
+
+// Synchronize the directory t with the remote, one level deep
+// Only files whose ETag or modification time changed are updated
+// Nothing is locked while listing, walks and reads carry on meanwhile
+// The listing is applied a page at a time as it arrives
 func (t *File) Sync() error {
 	// TODO - sync up as well?
-	// TODO - nested directories handling?
-	// TODO - download only files that have changed
+	if !t.dir {
+		return nil
+	}
 
-	remotes, err := ListBlobs(t.srv)
+	// Each page is applied as of when it was asked for
+	pass := time.Now()
+	asked := pass
+	err := listPages(t.srv.ctx, t.srv.backend, t.prefix(), "/", func(page ListPage) error {
+		t.syncPage(page, asked)
+		asked = time.Now()
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	locals := make([]string, len(t.Children))
-	for i, _ := range t.Children {
-		locals[i] = t.Children[i].name
+	t.prune(pass)
+
+	return nil
+}
+
+// Apply a page of the listing of t, asked for at listed, to the tree, returns the children it holds in name order
+func (t *File) syncPage(page ListPage, listed time.Time) []*File {
+	prefix := t.prefix()
+	files := make([]*File, 0, len(page.Blobs)+len(page.Prefixes))
+
+	for _, info := range page.Blobs {
+		name := strings.TrimPrefix(info.Name, prefix)
+		if name == "" {
+			continue
+		}
+
+		f, _ := t.syncChild(name, false, info, listed)
+		files = append(files, f)
+	}
+
+	for _, p := range page.Prefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+		if name == "" {
+			continue
+		}
+
+		f, _ := t.syncChild(name, true, BlobInfo{}, listed)
+		files = append(files, f)
 	}
 
-	diff := missingLocally(locals, remotes)
+	// A name listed as both a blob and a directory is whichever came last
+	kept := files[:0]
+	for _, f := range files {
+		if t.child(f.Name()) == f {
+			kept = append(kept, f)
+		}
+	}
 
-	for _, name := range diff {
-		// TODO - nested (and) dir handling
-		_, err := t.srv.Insert("/"+name, false)
-		if err != nil {
-			return errors.New("could not insert remote blobs into fs - " + err.Error())
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Name() < kept[j].Name()
+	})
+
+	return kept
+}
+
+// Finish a listing of t begun at pass, children it never reported were deleted remotely and leave the tree
+// Anything holding writes not yet uploaded stays, its upload will report the conflict
+// Children made here since the pass began are kept, they may be new creates
+func (t *File) prune(pass time.Time) {
+	for _, child := range t.children() {
+		if !child.seenBefore(pass) || child.pending() || !t.unlink(child) {
+			continue
 		}
+
+		log.Println("!!!! REMOTELY REMOVED", child.Path())
+		child.markGone()
 	}
 
-	return nil
+	t.mu.Lock()
+	t.synced = time.Now()
+	t.mu.Unlock()
 }
 
-// Find a full path within the tree
-func (t *File) Search(full string) (*File, error) {
-	cleaned := path.Clean(full)
-	files := strings.Split(cleaned, "/")
+// Was f last reported by a listing, or made here, before t?
+func (f *File) seenBefore(t time.Time) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.seen.Before(t)
+}
+
+// Bring the child name of t in line with a blob listed at listed, or a directory if isDir, reports whether it was created
+// A child of the other kind is replaced, unless it holds writes not yet uploaded
+// Blobs replaced under the same name drop what we cached of them
+func (t *File) syncChild(name string, isDir bool, info BlobInfo, listed time.Time) (*File, bool) {
+	f := t.child(name)
+	if f != nil && f.dir != isDir && !f.pending() && t.unlink(f) {
+		log.Println("!!!! REMOTELY REPLACED", f.Path())
+		f.markGone()
+	}
 
-	// Hack over split, drops the / entry, assume we're /
-	files = files[1:]
+	// Names a concurrent create has since added are left as they are
+	f, created := t.ensureChild(name, isDir)
+	if !f.dir && !isDir {
+		f.Blob.update(info, listed)
+	}
+
+	f.mu.Lock()
+	f.seen = time.Now()
+	f.mu.Unlock()
+
+	return f, created
+}
+
+// Has the directory t been listed yet? Directories are listed on first use
+func (t *File) listed() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return !t.synced.IsZero()
+}
+
+// Find a path within the tree, relative to t
+// `.` stays put and `..` climbs to the parent, the root is its own parent
+func (t *File) Search(full string) (*File, error) {
+	return t.resolve(full, false)
+}
 
+// Walk a path component by component from t, locking a directory at a time
+// With revalidate set, each directory walked through is synced first if stale or never listed
+func (t *File) resolve(full string, revalidate bool) (*File, error) {
 	found := t
 
-	// For every file to search for in the set
-Path:
-	for _, current := range files {
-		for _, child := range t.Children {
-			if child.name == current {
-				found = child
-				continue Path
+	for _, name := range strings.Split(full, "/") {
+		if name == "" {
+			continue
+		}
+
+		// Only directories have entries, even `.` and `..`
+		if !found.dir {
+			return nil, &LookupError{Path: full, Err: ErrNotDir}
+		}
+
+		switch name {
+		case ".":
+			continue
+		case "..":
+			if parent := found.Parent(); parent != nil {
+				found = parent
+			}
+			continue
+		}
+
+		// A failed listing is reported as it is, not as a missing file
+		if revalidate {
+			err := found.Revalidate()
+			if err != nil {
+				return nil, err
 			}
 		}
 
-		return nil, errors.New("could not find file")
+		child := found.child(name)
+		if child == nil {
+			return nil, &LookupError{Path: full, Err: os.ErrNotExist}
+		}
+
+		found = child
 	}
 
 	return found, nil
 }
 
-// Insert a new child somewhere in the tree ;; returns the Tree root
+// Insert a new child somewhere in the tree, returns the new child, or nil with an error
 func (t *File) Insert(full string, isDir bool) (*File, error) {
 	var parent *File = t
 	var err error = nil
@@ -118,18 +283,19 @@ func (t *File) Insert(full string, isDir bool) (*File, error) {
 
 	parent, err = t.Search(parentName)
 	if err != nil {
-		return t, errors.New(`could not find parent directory: "` + parentName + `" - ` + err.Error())
+		return nil, errors.New(`could not find parent directory: "` + parentName + `" - ` + err.Error())
 	}
 
 Root:
 
-	for _, child := range parent.Children {
-		if child.name == name {
-			return t, errors.New(`file "` + full + `" exists`)
-		}
+	if !parent.dir {
+		return nil, &LookupError{Path: full, Err: ErrNotDir}
 	}
 
-	f := parent.NewChild(name, isDir)
+	f, created := parent.ensureChild(name, isDir)
+	if !created {
+		return nil, &os.PathError{Op: "create", Path: full, Err: os.ErrExist}
+	}
 
 	// TODO - upload here?
 	//f.Blob.Upload(t.srv.ctx)
@@ -154,39 +320,429 @@ func (t *File) Delete(full string) error {
 
 	// Find the child of the parent
 Root:
-	for i, child := range parent.Children {
-		if child.name == name {
-			// Found the child, cut it from the child slice
-			left := parent.Children[:i]
-			if i < len(parent.Children)-1 {
-				right := parent.Children[i+1:]
-				parent.Children = append(left, right...)
-			} else {
-				parent.Children = left
+	child := parent.child(name)
+	if child == nil || !parent.unlink(child) {
+		return errors.New(`could not find child "` + name + `"`)
+	}
+
+	return nil
+}
+
+// Cut the immediate child f out of t, returns whether it was there
+func (t *File) unlink(f *File) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Another file may have taken the name since
+	name := f.Name()
+	if t.Children[name] != f {
+		return false
+	}
+
+	delete(t.Children, name)
+
+	return true
+}
+
+// Remove the blobs of the directory t from the remote
+// Unless all is set, only an empty directory and its marker blob may be removed
+func (t *File) RemoveDir(all bool) error {
+	if t.Parent() == nil {
+		return errors.New("cannot remove the root directory")
+	}
+
+	// Children may exist remotely we have not seen yet
+	err := t.Sync()
+	if err != nil {
+		return err
+	}
+
+	prefix := t.prefix()
+
+	if !all {
+		if len(t.children()) > 0 {
+			return ErrNotEmpty
+		}
+
+		// Anything besides the marker blob stops us, however much there is
+		marker, etag := false, ""
+		err = listPages(t.srv.ctx, t.srv.backend, prefix, "", func(page ListPage) error {
+			for _, info := range page.Blobs {
+				if info.Name != prefix {
+					return ErrNotEmpty
+				}
+
+				marker, etag = true, info.ETag
 			}
 
 			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Only the marker goes, blobs written since the check are kept
+		t.Discard()
+		if !marker {
+			return nil
+		}
+
+		log.Println("!!!! DELETING", prefix)
+		err = t.srv.backend.Delete(t.srv.ctx, prefix, etag)
+		if err != nil {
+			return errors.New(`could not remove "` + t.Path() + `" - ` + err.Error())
+		}
+
+		return nil
+	}
+
+	// Buffered writes beneath must not be uploaded again
+	t.Discard()
+
+	// Deleted a page at a time, only blobs as listed, anything changed since is kept
+	err = listPages(t.srv.ctx, t.srv.backend, prefix, "", func(page ListPage) error {
+		names := make([]string, 0, len(page.Blobs))
+		etags := make(map[string]string)
+		for _, info := range page.Blobs {
+			names = append(names, info.Name)
+			etags[info.Name] = info.ETag
 		}
+
+		return batch(names, func(name string) error {
+			log.Println("!!!! DELETING", name)
+			return t.srv.backend.Delete(t.srv.ctx, name, etags[name])
+		})
+	})
+	if err != nil {
+		return errors.New(`could not remove "` + t.Path() + `" - ` + err.Error())
 	}
 
-	return errors.New(`could not find child "` + name + `"`)
+	return nil
 }
 
-// Create a new File as a child of t
-func (t *File) NewChild(name string, isDir bool) *File {
+// Move f, and any blobs beneath it, to the full path dest
+// Regular files replace an existing regular file at dest
+func (f *File) Rename(dest string) error {
+	if f.Parent() == nil {
+		return errors.New("cannot rename the root directory")
+	}
+
+	dest = path.Clean(dest)
+	if dest == f.Path() {
+		return nil
+	}
+
+	if strings.HasPrefix(dest, f.Path()+"/") {
+		return errors.New("cannot move a directory beneath itself")
+	}
+
+	parentName, name := path.Split(dest)
+	parent, err := f.srv.File.Search(parentName)
+	if err != nil {
+		return errors.New(`could not find parent directory: "` + parentName + `" - ` + err.Error())
+	}
+
+	if !parent.dir {
+		return errors.New(`"` + parentName + `" is not a directory`)
+	}
+
+	existing := parent.child(name)
+	if existing != nil && (existing.dir || f.dir) {
+		return &os.PathError{Op: "rename", Path: dest, Err: os.ErrExist}
+	}
+
+	// Copies must carry buffered writes
+	err = f.Flush()
+	if err != nil {
+		return err
+	}
+
+	// Pair each source blob with its new name, and the ETag we know it by
+	var srcs []string
+	renames := make(map[string]string)
+	etags := make(map[string]string)
+	newKey := strings.TrimPrefix(dest, "/")
+
+	var mu sync.Mutex
+	copies := make(map[string]string) // ETags of the copies by new name
+	copyAll := func(names []string) error {
+		return batch(names, func(src string) error {
+			log.Println("!!!! COPYING", src, "→", renames[src])
+			info, err := f.srv.backend.Copy(f.srv.ctx, src, renames[src])
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			copies[renames[src]] = info.ETag
+			mu.Unlock()
+
+			return nil
+		})
+	}
+
+	// Copy everything before deleting anything, a failure leaves the sources intact
+	if f.dir {
+		// Copied a page at a time, as listed
+		prefix := f.prefix()
+		err = listPages(f.srv.ctx, f.srv.backend, prefix, "", func(page ListPage) error {
+			names := make([]string, 0, len(page.Blobs))
+			for _, info := range page.Blobs {
+				names = append(names, info.Name)
+				renames[info.Name] = newKey + "/" + strings.TrimPrefix(info.Name, prefix)
+				etags[info.Name] = info.ETag
+			}
+
+			srcs = append(srcs, names...)
+
+			return copyAll(names)
+		})
+	} else {
+		f.Blob.lock()
+		srcs = append(srcs, f.Blob.key())
+		renames[f.Blob.key()] = newKey
+		etags[f.Blob.key()] = f.Blob.etag
+		f.Blob.unlock()
+
+		err = copyAll(srcs)
+	}
+	if err != nil {
+		return errors.New(`could not copy "` + f.Path() + `" - ` + err.Error())
+	}
+
+	// Sources changed since we saw them are kept
+	err = batch(srcs, func(src string) error {
+		log.Println("!!!! DELETING", src)
+		return f.srv.backend.Delete(f.srv.ctx, src, etags[src])
+	})
+	if err != nil {
+		return errors.New(`could not delete "` + f.Path() + `" after copy - ` + err.Error())
+	}
+
+	// Reattach in the tree, blob names follow the path
+	if existing != nil {
+		parent.unlink(existing)
+	}
+
+	f.Parent().unlink(f)
+
+	f.mu.Lock()
+	f.parent = parent
+	f.name = name
+	f.seen = time.Now()
+	f.mu.Unlock()
+
+	parent.mu.Lock()
+	parent.Children[name] = f
+	parent.mu.Unlock()
+
+	// Later writes are conditional on the copies
+	f.walk(func(file *File) {
+		file.Blob.lock()
+		defer file.Blob.unlock()
+
+		if etag, ok := copies[file.Blob.key()]; ok {
+			file.Blob.mu.Lock()
+			file.Blob.etag = etag
+			file.Blob.known = time.Now()
+			file.Blob.mu.Unlock()
+		}
+	})
+
+	return nil
+}
+
+// Call fn on f and every file beneath it
+func (f *File) walk(fn func(*File)) {
+	fn(f)
+
+	for _, child := range f.children() {
+		child.walk(fn)
+	}
+}
+
+// Upload buffered writes for f and every file beneath it
+func (f *File) Flush() error {
+	if !f.dir {
+		return f.Blob.Flush(f.srv.ctx)
+	}
+
+	for _, child := range f.children() {
+		err := child.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Does f, or any file beneath it, hold writes not yet uploaded?
+func (f *File) pending() bool {
+	if !f.dir {
+		return f.Blob.isDirty()
+	}
+
+	for _, child := range f.children() {
+		if child.pending() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Mark f and every file beneath it deleted remotely
+func (f *File) markGone() {
+	f.walk(func(file *File) {
+		file.mu.Lock()
+		file.gone = true
+		file.mu.Unlock()
+	})
+}
+
+// Was f deleted remotely?
+func (f *File) isGone() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.gone
+}
+
+// Drop buffered writes for f and every file beneath it
+func (f *File) Discard() {
+	if !f.dir {
+		f.Blob.discard(f.srv.ctx)
+		return
+	}
+
+	for _, child := range f.children() {
+		child.Discard()
+	}
+}
+
+// Run fn over names in concurrent batches of removeBatch, returns the first error
+// Batching keeps huge directories from opening unbounded connections
+func batch(names []string, fn func(string) error) error {
+	for len(names) > 0 {
+		n := removeBatch
+		if n > len(names) {
+			n = len(names)
+		}
+
+		errs := make(chan error, n)
+		for _, name := range names[:n] {
+			go func(name string) {
+				errs <- fn(name)
+			}(name)
+		}
+
+		var err error
+		for i := 0; i < n; i++ {
+			if e := <-errs; e != nil && err == nil {
+				err = e
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		names = names[n:]
+	}
+
+	return nil
+}
+
+// Find the child name of t, creating it if there is none, reports whether it was created
+func (t *File) ensureChild(name string, isDir bool) (*File, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if child := t.lookupChild(name); child != nil {
+		return child, false
+	}
+
 	child := &File{
 		parent:   t,
 		srv:      t.srv,
 		name:     name,
 		dir:      isDir,
-		Children: make([]*File, 0, maxChildren),
+		last:     time.Now(),
+		seen:     time.Now(),
+		Children: make(map[string]*File),
 	}
 
 	// Hope this isn't nil :)
-	child.Blob = NewBlob(&child.name, t.srv.container)
+	child.Blob = NewBlob(child, t.srv.backend)
+
+	t.Children[name] = child
+
+	return child, true
+}
+
+// Find an immediate child by name, nil if there is none
+func (t *File) child(name string) *File {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 
-	t.Children = append(t.Children, child)
-	return child
+	return t.lookupChild(name)
+}
+
+// Find an immediate child by name - caller holds t.mu
+func (t *File) lookupChild(name string) *File {
+	return t.Children[name]
+}
+
+// A snapshot of the children of t in no particular order, safe to range over while the tree changes
+func (t *File) children() []*File {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	children := make([]*File, 0, len(t.Children))
+	for _, child := range t.Children {
+		children = append(children, child)
+	}
+
+	return children
+}
+
+// Number of children of t
+func (t *File) count() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.Children)
+}
+
+// Directory holding f, nil for the root
+func (f *File) Parent() *File {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.parent
+}
+
+// Full path of the file within the tree `/a/b` for `b` in `/a`
+func (f *File) Path() string {
+	f.mu.RLock()
+	parent, name := f.parent, f.name
+	f.mu.RUnlock()
+
+	if parent == nil {
+		return "/"
+	}
+
+	return path.Join(parent.Path(), name)
+}
+
+// Blob name prefix shared by everything under the directory `a/b/` for `/a/b`
+func (t *File) prefix() string {
+	if t.Parent() == nil {
+		return ""
+	}
+
+	return strings.TrimPrefix(t.Path(), "/") + "/"
 }
 
 // Total number of files in the tree
@@ -196,7 +752,7 @@ func (t *File) Len() uint64 {
 	descend = func(t *File) uint64 {
 		size := uint64(1)
 
-		for _, child := range t.Children {
+		for _, child := range t.children() {
 			size += descend(child)
 		}
 
@@ -216,195 +772,321 @@ func (f *File) Open() error {
 	return nil
 }
 
-// Close file
+// Close file, committing any writes still buffered
 func (f *File) Close() error {
-	// TODO - anything? maybe sync up to azure since we know we're done?
+	log.Println("!!!! CLOSE")
 	if f.IsDir() {
-		f.reloadInfo()
+		return nil
 	}
-	log.Println("!!!! CLOSE")
-	return nil
+
+	// Read-ahead is only trusted while the file is held open
+	f.Blob.lock()
+	f.Blob.window = nil
+	f.Blob.unlock()
+
+	return f.Blob.Close(f.srv.ctx)
 }
 
 // Write from a certain offset - not called for directories
+// Writes collect in the body and are uploaded on clunk, fsync, or a dirty-size or idle threshold
 func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
-	// Sync root
-	f.srv.File.Sync()
-
 	log.Println("!!!! WRITEAT off= ", off)
 
-	// TODO - Contents() maybe should have to sync - done above anyways for now
-	buf := f.Blob.Contents()
-
-	// Might not be necessary or correct
-	if off > int64(len(buf)) {
-		return 0, io.EOF
+	if f.isGone() {
+		return 0, os.ErrNotExist
 	}
 
-	// Truncate file and write from offset
-	// TODO - should this casting be guarded?
-	if off < int64(len(buf)) {
-		// Truncating might not be the answer if this is intended
-		// to be insert rather than overwrite
-		f.Blob.body.Truncate(int(off))
+	f.Blob.lock()
+	defer f.Blob.unlock()
+
+	// Writes after dropped ones would be made to someone else's contents
+	if f.Blob.lost != nil {
+		return 0, f.Blob.lost
 	}
 
-	n, err = f.Blob.body.Write(p)
-	if err != nil {
-		return n, err
+	// Append and page blobs are written straight through, without a copy of the contents
+	switch f.Blob.kind {
+	case AppendBlob:
+		return f.Blob.Append(f.srv.ctx, p)
+	case PageBlob:
+		return f.Blob.WritePages(f.srv.ctx, p, off)
 	}
 
-	// Upload to blob storage
-	err = f.Blob.Upload(f.srv.ctx)
+	// Writes land on top of the current contents
+	err = f.Blob.load(f.srv.ctx)
 	if err != nil {
-		// Undo changes if we fail
-		f.Blob.body.Reset()
-		f.Blob.body.Write(buf)
 		return 0, err
 	}
 
+	if off < 0 {
+		return 0, errors.New("negative write offset")
+	}
+
+	// Overwrite in place, growing the file as needed
+	// Writing past the end leaves a gap of zeros
+	size := int64(f.Blob.body.Len())
+	end := off + int64(len(p))
+	if end > size {
+		f.Blob.body.Write(make([]byte, end-size))
+	}
+
+	n = copy(f.Blob.Contents()[off:], p)
+
+	// A gap counts as written too
+	start := off
+	if start > size {
+		start = size
+	}
+
+	f.Blob.dirtied(start, int(end-start))
+	f.setLast(time.Now())
+
+	// Commit once enough has built up, otherwise once writes go quiet
+	if f.srv.dirtyMax > 0 && f.Blob.unsent >= f.srv.dirtyMax {
+		err = f.Blob.commit(f.srv.ctx)
+		if err != nil {
+			// The write stays buffered for the next attempt, unless a conflict dropped it
+			return 0, err
+		}
+	} else if f.srv.idle > 0 {
+		f.Blob.flushAfter(f.srv.ctx, f.srv.idle)
+	}
+
 	return
 }
 
+// Resize the file to size bytes, zero-extending it if it grows
+func (f *File) Truncate(size int64) error {
+	if f.dir {
+		return errors.New("cannot truncate a directory")
+	}
+
+	if size < 0 {
+		return errors.New("negative truncate size")
+	}
+
+	log.Println("!!!! TRUNCATE size= ", size)
+
+	f.Blob.lock()
+	defer f.Blob.unlock()
+
+	// Like writes, nothing lands on the contents of whoever won a conflict
+	if f.Blob.lost != nil {
+		return f.Blob.lost
+	}
+
+	// Append blobs never shrink, page blobs resize in whole pages
+	switch f.Blob.kind {
+	case AppendBlob:
+		if size == f.Blob.size {
+			return nil
+		}
+
+		return ErrAppendTruncate
+	case PageBlob:
+		return f.Blob.ResizePages(f.srv.ctx, size)
+	}
+
+	// Work from the current contents, none are needed to empty the file
+	// Buffered writes are newer than the remote
+	if size > 0 && !f.Blob.dirty {
+		err := f.Blob.Download(f.srv.ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// What to go back to should the upload fail
+	old := append([]byte(nil), f.Blob.Contents()...)
+	oldSize, dirty, unsent := f.Blob.size, f.Blob.dirty, f.Blob.unsent
+	spans := append([][2]int64(nil), f.Blob.spans...)
+
+	if size < int64(len(old)) {
+		f.Blob.body.Truncate(int(size))
+	} else {
+		f.Blob.body.Write(make([]byte, size-int64(len(old))))
+	}
+
+	// Upload to blob storage, along with any buffered writes
+	if size > int64(len(old)) {
+		f.Blob.dirtied(int64(len(old)), int(size-int64(len(old))))
+	} else {
+		f.Blob.dirtied(size, 0)
+	}
+
+	err := f.Blob.commit(f.srv.ctx)
+	if errors.Is(err, ErrConflict) {
+		// Already dropped along with any buffered writes
+		return err
+	}
+	if err != nil {
+		// Undo changes if we fail, a clean blob stays clean and is read from the remote again
+		if !dirty {
+			f.Blob.drop()
+		} else {
+			f.Blob.body.Reset()
+			f.Blob.body.Write(old)
+			f.Blob.unsent = unsent
+			f.Blob.spans = spans
+		}
+
+		f.Blob.mu.Lock()
+		f.Blob.size = oldSize
+		f.Blob.dirty = dirty
+		f.Blob.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
 // Read from a certain offset - not called for directories
 func (f *File) ReadAt(p []byte, offset int64) (n int, err error) {
-	// Sync root
-	f.srv.File.Sync()
-
 	log.Println("!!!! READAT")
 
-	// TODO - don't download the whole file each time
-	f.Blob.Download(f.srv.ctx)
-
 	if f.dir {
 		// This will not be called
-		// See: Readdir()
+		// See: Listing
+	}
+
+	if f.isGone() {
+		return 0, os.ErrNotExist
 	}
 
-	if offset >= f.Size() {
+	// Reads of a file take turns, they share the read-ahead window
+	f.Blob.lock()
+	defer f.Blob.unlock()
+
+	if offset >= f.Blob.size {
 		return 0, io.EOF
 	}
 
-	buf := f.Blob.Contents()
-	n = copy(p, buf[offset:])
+	// Contents we hold are current, otherwise fetch only the range asked for
+	if f.Blob.loaded {
+		buf := f.Blob.Contents()
+		n = copy(p, buf[offset:])
+		if n < len(p) {
+			return n, io.EOF
+		}
 
-	return n, nil
+		return n, nil
+	}
+
+	return f.Blob.ReadRange(f.srv.ctx, p, offset, f.srv.readAhead)
 }
 
 // Is this file a directory?
-func (f File) IsDir() bool {
-	// Sync root
-	f.srv.File.Sync()
-
+func (f *File) IsDir() bool {
 	return f.dir
 }
 
 // Returns the singleton name of the file `/foo/bar` is `bar`
-func (f File) Name() string {
-	// Sync root
-	f.srv.File.Sync()
+func (f *File) Name() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 
 	return f.name
 }
 
 // Returns the size of the file contents
-func (f File) Size() int64 {
-	// Sync root
-	f.srv.File.Sync()
-
+func (f *File) Size() int64 {
 	log.Println("!!!! SIZE")
 
 	if f.IsDir() {
 		// Size is number of children
 		// Seems to work
 		// Previously: 0
-		return int64(len(f.Children))
+		return int64(f.count())
 	}
 
-	// TODO - get this info from azure, not the buffer, for lazy loading
-	return int64(len(f.Blob.Contents()))
+	// Known from listings without downloading the contents
+	size, _ := f.Blob.props()
+
+	return size
 }
 
 // Returns the permission bits (uint32)
-func (f File) Mode() os.FileMode {
-	// Sync root
-	f.srv.File.Sync()
-
+func (f *File) Mode() os.FileMode {
 	// TODO - derive from azure storage and XOR sane defaults?
 	if f.IsDir() {
 		// We are a directory
 		return os.ModeDir | 0777
 	}
 
+	// Append blobs only grow
+	if f.kind() == AppendBlob {
+		return os.ModeAppend | 0777
+	}
+
 	// We are a regular file
 	return 0777
 }
 
-// Returns the time of the last modification of the file
-func (f File) ModTime() time.Time {
-	// Sync root
-	f.srv.File.Sync()
+// Owner of every file is the container
+func (f *File) Uid() string {
+	return *containerName
+}
+
+// Group of a file is its blob type, directories have none
+func (f *File) Gid() string {
+	if f.dir {
+		return ""
+	}
 
-	// TODO - ask blob storage?
-	return time.Now()
+	return string(f.kind())
 }
 
-// Returns "the underlying data source"
-func (f File) Sys() interface{} {
-	// Sync root
-	f.srv.File.Sync()
+// Type of blob backing the file
+func (f *File) kind() BlobType {
+	_, kind := f.Blob.props()
 
-	// TODO?
-	return nil
+	return kind
 }
 
-// Returns the info that styx wants
-func (f File) Stat() os.FileInfo {
-	// Sync root
-	f.srv.File.Sync()
+// Returns the time of the last modification of the file
+func (f *File) ModTime() time.Time {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 
-	return f
+	return f.last
 }
 
-// Reload the channel for Readdir()
-func (f *File) reloadInfo() {
-	log.Println("« Reloading info for file: ", f.Name())
-	f.info = make(chan os.FileInfo, infoBuf)
-	go func() {
-		for i := 0; i < len(f.Children); i++ {
-			f.info <- f.Children[i]
-		}
-		close(f.info)
-	}()
+// Record the time of the last modification of the file
+func (f *File) setLast(mtime time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.last = mtime
 }
 
-// Styx says we must implement Readdir() or marshal directory information ourselves through ReadAt()
-// See: https://pkg.go.dev/aqwari.net/net/styx?tab=doc#Directory
-func (f *File) Readdir(n int) ([]os.FileInfo, error) {
-	// Sync root
-	f.srv.File.Sync()
+// Set the modification time, files persist it in blob metadata
+// Directories have nowhere to keep it and only change in the tree
+func (f *File) SetModTime(mtime time.Time) error {
+	if !f.dir {
+		// Committing later writes would replace the metadata
+		err := f.Blob.Flush(f.srv.ctx)
+		if err != nil {
+			return err
+		}
 
-	// Nothing to list
-	if len(f.Children) == 0 {
-		return nil, io.EOF
+		err = f.Blob.SetModTime(f.srv.ctx, mtime)
+		if err != nil {
+			return err
+		}
 	}
 
-	// If channel is nil, push into channel
-	// We will close when done
+	f.setLast(mtime)
 
-	if f.info == nil {
-		f.reloadInfo()
-	}
+	return nil
+}
 
-	var err error
-	fi := make([]os.FileInfo, 0, infoBuf)
-	for i := 0; i < n; i++ {
-		s, ok := <-f.info
-		if !ok {
-			err = io.EOF
-			break
-		}
-		fi = append(fi, s)
-	}
-	return fi, err
+// Returns "the underlying data source"
+func (f *File) Sys() interface{} {
+	// TODO?
+	return nil
+}
+
+// Returns the info that styx wants
+func (f *File) Stat() os.FileInfo {
+	return f
 }
@@ -5,5 +5,6 @@ go 1.16
 require (
 	aqwari.net/net/styx v0.0.0-20201205223803-0320e6f6d7b1
 	aqwari.net/retry v0.0.0-20180428204214-1281ce5d8df0 // indirect
+	github.com/Azure/azure-pipeline-go v0.2.3
 	github.com/Azure/azure-storage-blob-go v0.14.0
 )
@@ -0,0 +1,120 @@
+// Copyright (c) 2020 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Directory reads - every open fid lists the remote a page at a time
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// An open directory, reads walk the listing of its blobs a page at a time
+// Only the page being read is held, the backend's marker says where the next one starts
+// styx turns entries into stats, with the same qids walks and stats of them get
+type Listing struct {
+	*File
+	mu     sync.Mutex
+	pass   time.Time // When the first read began, zero before any
+	marker string    // Where the next page starts
+	done   bool      // Has the last page been fetched?
+	page   []*File   // Children of the page held not yet read
+}
+
+// Open the directory f for reading, the listing is taken as it is read
+func (f *File) List() *Listing {
+	return &Listing{File: f}
+}
+
+// Value to hand styx when opening f, directories get a listing of their own
+func (f *File) open() interface{} {
+	if f.dir {
+		return f.List()
+	}
+
+	return f.VF()
+}
+
+// Start the listing from its first page - caller holds l.mu
+func (l *Listing) start() error {
+	log.Println("« Listing", l.Path())
+
+	l.pass = time.Now()
+	l.marker = ""
+	l.done = false
+	l.page = nil
+
+	return l.next()
+}
+
+// Fetch the page after the one held, applying it to the tree - caller holds l.mu
+// Once the last page is in, children no page reported leave the tree
+func (l *Listing) next() error {
+	asked := time.Now()
+	page, err := l.srv.backend.List(l.srv.ctx, l.prefix(), "/", l.marker)
+	if err != nil {
+		return err
+	}
+
+	l.page = l.File.syncPage(page, asked)
+
+	l.marker = page.Next
+	if l.marker == "" {
+		l.done = true
+		l.File.prune(l.pass)
+	}
+
+	return nil
+}
+
+// Return up to n entries after those already read, all of the page held for n <= 0
+// The next page is fetched once the held one is read
+func (l *Listing) Readdir(n int) ([]os.FileInfo, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pass.IsZero() {
+		err := l.start()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Pages may come back empty with more to follow
+	for len(l.page) == 0 && !l.done {
+		err := l.next()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(l.page) == 0 {
+		return nil, io.EOF
+	}
+
+	if n <= 0 || n > len(l.page) {
+		n = len(l.page)
+	}
+
+	infos := make([]os.FileInfo, 0, n)
+	for _, child := range l.page[:n] {
+		infos = append(infos, child.VF())
+	}
+	l.page = l.page[n:]
+
+	return infos, nil
+}
+
+// Drop the page held
+func (l *Listing) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pass = time.Time{}
+	l.page = nil
+
+	return nil
+}
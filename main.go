@@ -10,21 +10,31 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"aqwari.net/net/styx"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
-const (
-	maxBlobs = 4096 // Maximum number of blobs to track
-)
-
 var (
 	//announce      = flag.String("a", "tcp!localhost!1337", "Dialstring to announce on") // TODO
 	containerName = flag.String("c", "9pfs", "Name of container to fs-ify")
 	port          = flag.String("p", ":1337", "TCP port to listen for 9p connections")
 	chatty        = flag.Bool("D", false, "Chatty 9p tracing")
 	verbose       = flag.Bool("V", false, "Verbose 9p error output")
+	recursive     = flag.Bool("R", false, "Remove directories recursively, deleting every blob under them")
+	readAhead     = flag.Int64("r", 1024*1024, "Bytes to read ahead of each ranged read, 0 disables")
+	dirtyMax      = flag.Int64("w", 64*1024*1024, "Bytes of buffered writes which force an upload, 0 waits for clunk")
+	idle          = flag.Duration("i", 5*time.Second, "Upload buffered writes after this long without a write, 0 waits for clunk")
+	blobType      = flag.String("t", "block", "Type of newly created blobs: block, append or page")
+	typeRules     = flag.String("T", "", "Blob types chosen by name suffix for new files, as in .vhd=page,.log=append")
+	blockSize     = flag.Int64("b", 4*1024*1024, "Block size for uploading only changed parts of a blob, 0 uploads whole blobs")
+	ttl           = flag.Duration("s", 5*time.Second, "How long a directory listing is trusted before listing it again")
+	refresh       = flag.Duration("S", 30*time.Second, "Interval between background refreshes of stale directories, 0 disables")
+	queueName     = flag.String("q", "", "Storage queue receiving Event Grid blob events for the container, applied as they arrive")
+	cacheDir      = flag.String("C", "", "Directory keeping blob contents read across restarts, empty disables")
+	cacheMax      = flag.Int64("m", 1024*1024*1024, "Bytes kept in the cache directory, 0 for no limit")
+	cacheAge      = flag.Duration("a", 24*time.Hour, "Time since last use after which cached contents are dropped, 0 for no limit")
 )
 
 // A 9p file server exposing an azure blob container
@@ -38,6 +48,16 @@ func main() {
 
 	srv.Initialize()
 
+	typ, err := ParseBlobType(*blobType)
+	if err != nil {
+		fatal("err: ", err)
+	}
+
+	rules, err := parseTypeRules(*typeRules)
+	if err != nil {
+		fatal("err: ", err)
+	}
+
 	log.Printf("Using %s as the container for the fs...\n", *containerName)
 
 	/* Set up Azure */
@@ -64,10 +84,35 @@ func main() {
 	}
 
 	container := azblob.NewContainerURL(*urlStr, p)
+
+	var events EventSource
+	if *queueName != "" {
+		queueURL, err := url.Parse(fmt.Sprintf("https://%s.queue.core.windows.net/%s", accountName, *queueName))
+		if err != nil {
+			fatal("err: could not generate queue URL - ", err)
+		}
+
+		events = NewQueueSource(p, *queueURL, *containerName)
+	}
 	ctx := context.Background()
 
-	srv.container = container
+	srv.backend = NewAzureBackend(container)
 	srv.ctx = ctx
+	srv.recursive = *recursive
+	srv.readAhead = *readAhead
+	srv.dirtyMax = *dirtyMax
+	srv.idle = *idle
+	srv.blockSize = *blockSize
+	srv.blobType = typ
+	srv.typeRules = rules
+	srv.ttl = *ttl
+
+	if *cacheDir != "" {
+		srv.cache, err = OpenCache(*cacheDir, *cacheMax, *cacheAge)
+		if err != nil {
+			fatal("err: could not open cache directory - ", err)
+		}
+	}
 
 	// We only need the error
 	_, err = container.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
@@ -93,8 +138,6 @@ func main() {
 
 	/* Populate tree with contents from the container */
 
-	var names []string
-
 	// Skip population if the container didn't exist, there's nothing contained
 	if !exists {
 		goto Styx
@@ -102,30 +145,19 @@ func main() {
 
 	log.Println("Reading existing blobs from container...")
 
-	// List all remote blobs
-	names, err = ListBlobs(&srv)
+	// Build the tree from blob name prefixes, `a/b/c` is file `c` in directory `/a/b`
+	// Only the top level is listed now, directories beneath on first use
+	err = srv.File.Populate()
 	if err != nil {
-		fatal("err: could not list remote blobs - ", err)
+		fatal("err: could not populate fs from remote blobs - ", err)
 	}
 
-	if len(names) < 1 {
+	if srv.File.Len() < 2 {
 		log.Println("No extant blobs found, continuing...")
 		goto Styx
 	}
 
-	log.Printf("Found %d extant blobs, populating fs...\n", len(names))
-
-	// Insert blobs into file tree
-	// TODO - some kind of nested directory handling?
-	for _, name := range names {
-		f, err := srv.Insert("/"+name, false)
-		if err != nil {
-			fatal("err: could not insert extant blobs into fs - ", err)
-		}
-
-		// TODO - lazy download - we only need meta-info, not the whole file
-		f.Blob.Download(srv.ctx)
-	}
+	log.Printf("Populated fs with %d extant files and directories at the top level\n", srv.File.Len()-1)
 
 	/* Set up 9p server */
 Styx:
@@ -142,6 +174,16 @@ Styx:
 	//proto, addr, port := dialstring.Parse(*announce)
 	styxServer.Addr = *port
 
+	// Pick up remote changes to directories nobody is looking at
+	if *refresh > 0 {
+		go srv.Refresh(*refresh)
+	}
+
+	// Apply remote changes as they are reported
+	if events != nil {
+		go srv.Watch(events)
+	}
+
 	// Shim our own logger, in case we need it
 	styxServer.Handler = styx.Stack(logger, &srv)
 
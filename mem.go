@@ -0,0 +1,505 @@
+// Copyright (c) 2020 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// In-memory implementation of Backend, used for offline testing
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	memPageMax = 5000 // Names on a page of a listing, as Azure returns at most
+)
+
+// A blob held in memory
+type memBlob struct {
+	info   BlobInfo
+	data   []byte
+	blocks []BlockInfo // Committed blocks, none when put whole
+}
+
+// Backend keeping every blob in process memory
+type MemBackend struct {
+	sync.Mutex
+	blobs   map[string]*memBlob
+	staged  map[string]map[string][]byte // Uncommitted blocks by blob, then block ID
+	version uint64                       // Source of unique ETags
+	pageMax int                          // Most names on a page of a listing
+}
+
+// Create a new, empty, in-memory backend
+func NewMemBackend() *MemBackend {
+	return &MemBackend{
+		blobs:   make(map[string]*memBlob),
+		staged:  make(map[string]map[string][]byte),
+		pageMax: memPageMax,
+	}
+}
+
+// Store data under name with props, stamping fresh properties - caller holds the lock
+func (m *MemBackend) store(name string, typ BlobType, data []byte, props BlobProps) BlobInfo {
+	m.version++
+
+	ctype := props.ContentType
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+
+	b := &memBlob{
+		info: BlobInfo{
+			Name:         name,
+			Type:         typ,
+			Size:         int64(len(data)),
+			ETag:         fmt.Sprintf("\"0x%X\"", m.version),
+			ContentType:  ctype,
+			LastModified: time.Now(),
+			Metadata:     make(map[string]string),
+		},
+		data: data,
+	}
+
+	for k, v := range props.Metadata {
+		b.info.Metadata[k] = v
+	}
+
+	m.blobs[name] = b
+
+	return b.info
+}
+
+// Properties a change to part of the contents keeps
+func (b *memBlob) props() BlobProps {
+	return BlobProps{ContentType: b.info.ContentType, Metadata: b.info.Metadata}
+}
+
+// Find a blob by name - caller holds the lock
+func (m *MemBackend) find(name string) (*memBlob, error) {
+	b, ok := m.blobs[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return b, nil
+}
+
+// Check a conditional change against the ETag of a blob - caller holds the lock
+func (m *MemBackend) check(name, match string) error {
+	if match == "" {
+		return nil
+	}
+
+	b, ok := m.blobs[name]
+	if match == IfAbsent {
+		if ok {
+			return os.ErrExist
+		}
+
+		return nil
+	}
+
+	if !ok || b.info.ETag != match {
+		return ErrConflict
+	}
+
+	return nil
+}
+
+// List a page of blobs whose names begin with prefix, rolling names up to delim into prefixes
+// The marker is the last name of the page before
+func (m *MemBackend) List(ctx context.Context, prefix, delim, marker string) (ListPage, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	// Blobs and prefixes share one order, a page holds pageMax of either
+	infos := make(map[string]BlobInfo)
+	seen := make(map[string]bool)
+	var names []string
+
+	for name, b := range m.blobs {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		rest := name[len(prefix):]
+		if i := strings.Index(rest, delim); delim != "" && i >= 0 {
+			name = prefix + rest[:i+len(delim)]
+		} else {
+			infos[name] = b.info
+		}
+
+		if name > marker && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	var page ListPage
+	for i, name := range names {
+		if len(page.Blobs)+len(page.Prefixes) == m.pageMax {
+			page.Next = names[i-1]
+			break
+		}
+
+		if info, ok := infos[name]; ok {
+			page.Blobs = append(page.Blobs, info)
+		} else {
+			page.Prefixes = append(page.Prefixes, name)
+		}
+	}
+
+	return page, nil
+}
+
+// Properties of a single blob
+func (m *MemBackend) Stat(ctx context.Context, name string) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, err := m.find(name)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	return b.info, nil
+}
+
+// Read count bytes starting at off, a negative count reads to the end
+func (m *MemBackend) Get(ctx context.Context, name string, off, count int64) ([]byte, string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, err := m.find(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	size := int64(len(b.data))
+	if off < 0 || off > size {
+		return nil, "", errors.New(`range out of bounds for blob "` + name + `"`)
+	}
+
+	end := size
+	if count >= 0 && off+count < size {
+		end = off + count
+	}
+
+	out := make([]byte, end-off)
+	copy(out, b.data[off:end])
+
+	return out, b.info.ETag, nil
+}
+
+// Create or replace a blob in full with the given properties, returns its new properties
+func (m *MemBackend) Put(ctx context.Context, name string, data []byte, props BlobProps, match string) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.check(name, match); err != nil {
+		return BlobInfo{}, err
+	}
+
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	delete(m.staged, name)
+
+	return m.store(name, BlockBlob, buf, props), nil
+}
+
+// The committed blocks of a blob in order, none for a blob uploaded whole
+func (m *MemBackend) Blocks(ctx context.Context, name string) ([]BlockInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, err := m.find(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]BlockInfo(nil), b.blocks...), nil
+}
+
+// Upload a block, it is not part of the blob until committed
+func (m *MemBackend) StageBlock(ctx context.Context, name, id string, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.staged[name] == nil {
+		m.staged[name] = make(map[string][]byte)
+	}
+
+	m.staged[name][id] = append([]byte(nil), data...)
+
+	return nil
+}
+
+// Replace the contents and properties of a blob with the listed staged or committed blocks
+func (m *MemBackend) CommitBlocks(ctx context.Context, name string, ids []string, props BlobProps, match string) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.check(name, match); err != nil {
+		return BlobInfo{}, err
+	}
+
+	// Committed blocks may be listed again, by ID
+	committed := make(map[string][]byte)
+	if b, ok := m.blobs[name]; ok {
+		var off int64
+		for _, block := range b.blocks {
+			committed[block.ID] = b.data[off : off+block.Size]
+			off += block.Size
+		}
+	}
+
+	var data []byte
+	blocks := make([]BlockInfo, 0, len(ids))
+	for _, id := range ids {
+		block, ok := m.staged[name][id]
+		if !ok {
+			block, ok = committed[id]
+		}
+		if !ok {
+			return BlobInfo{}, errors.New(`block "` + id + `" of blob "` + name + `" not found`)
+		}
+
+		if len(blocks) > 0 && len(id) != len(blocks[0].ID) {
+			return BlobInfo{}, errors.New(`block IDs of blob "` + name + `" differ in length`)
+		}
+
+		data = append(data, block...)
+		blocks = append(blocks, BlockInfo{ID: id, Size: int64(len(block))})
+	}
+
+	// Blocks left uncommitted are thrown away
+	delete(m.staged, name)
+
+	info := m.store(name, BlockBlob, data, props)
+	m.blobs[name].blocks = blocks
+
+	return info, nil
+}
+
+// Replace the user-defined metadata of a blob
+func (m *MemBackend) SetMetadata(ctx context.Context, name string, meta map[string]string, match string) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, err := m.find(name)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	if err := m.check(name, match); err != nil {
+		return BlobInfo{}, err
+	}
+
+	// The committed block list is kept, as by Azure
+	blocks := b.blocks
+	info := m.store(name, b.info.Type, b.data, BlobProps{ContentType: b.info.ContentType, Metadata: meta})
+	m.blobs[name].blocks = blocks
+
+	return info, nil
+}
+
+// Remove a blob
+func (m *MemBackend) Delete(ctx context.Context, name string, match string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, err := m.find(name); err != nil {
+		return err
+	}
+
+	if err := m.check(name, match); err != nil {
+		return err
+	}
+
+	delete(m.blobs, name)
+	delete(m.staged, name)
+
+	return nil
+}
+
+// Copy a blob to a new name
+func (m *MemBackend) Copy(ctx context.Context, src, dst string) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, err := m.find(src)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	buf := make([]byte, len(b.data))
+	copy(buf, b.data)
+
+	// Copies keep the block list of the source, as by Azure
+	info := m.store(dst, b.info.Type, buf, b.props())
+	m.blobs[dst].blocks = append([]BlockInfo(nil), b.blocks...)
+
+	return info, nil
+}
+
+// Find a blob by name and check its type - caller holds the lock
+func (m *MemBackend) findType(name string, typ BlobType) (*memBlob, error) {
+	b, err := m.find(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.info.Type != typ {
+		return nil, errors.New(`blob "` + name + `" is not a ` + string(typ) + ` blob`)
+	}
+
+	return b, nil
+}
+
+// Check a page range is aligned and within size
+func checkPages(name string, off, count, size int64) error {
+	if off%pageSize != 0 || count%pageSize != 0 {
+		return errors.New(`unaligned page range for blob "` + name + `"`)
+	}
+
+	if off < 0 || off+count > size {
+		return errors.New(`page range out of bounds for blob "` + name + `"`)
+	}
+
+	return nil
+}
+
+// Create an empty append blob, replacing any blob of the name matching the ETag
+func (m *MemBackend) CreateAppend(ctx context.Context, name string, match string) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.check(name, match); err != nil {
+		return BlobInfo{}, err
+	}
+
+	delete(m.staged, name)
+
+	return m.store(name, AppendBlob, nil, BlobProps{}), nil
+}
+
+// Add at most maxPut bytes to the end of an append blob
+func (m *MemBackend) Append(ctx context.Context, name string, data []byte) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, err := m.findType(name, AppendBlob)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	if len(data) > maxPut {
+		return BlobInfo{}, errors.New(`append to blob "` + name + `" too large`)
+	}
+
+	buf := append(append([]byte(nil), b.data...), data...)
+
+	return m.store(name, AppendBlob, buf, b.props()), nil
+}
+
+// Create a zeroed page blob of size bytes, replacing any blob of the name matching the ETag
+func (m *MemBackend) CreatePages(ctx context.Context, name string, size int64, match string) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.check(name, match); err != nil {
+		return BlobInfo{}, err
+	}
+
+	if err := checkPages(name, 0, size, size); err != nil {
+		return BlobInfo{}, err
+	}
+
+	delete(m.staged, name)
+
+	return m.store(name, PageBlob, make([]byte, size), BlobProps{}), nil
+}
+
+// Write at most maxPut bytes of pages starting at off
+func (m *MemBackend) PutPages(ctx context.Context, name string, off int64, data []byte, match string) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, err := m.findType(name, PageBlob)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	if err := m.check(name, match); err != nil {
+		return BlobInfo{}, err
+	}
+
+	if err := checkPages(name, off, int64(len(data)), int64(len(b.data))); err != nil {
+		return BlobInfo{}, err
+	}
+
+	if len(data) > maxPut {
+		return BlobInfo{}, errors.New(`page write to blob "` + name + `" too large`)
+	}
+
+	buf := append([]byte(nil), b.data...)
+	copy(buf[off:], data)
+
+	return m.store(name, PageBlob, buf, b.props()), nil
+}
+
+// Zero count bytes of pages starting at off
+func (m *MemBackend) ClearPages(ctx context.Context, name string, off, count int64, match string) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, err := m.findType(name, PageBlob)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	if err := m.check(name, match); err != nil {
+		return BlobInfo{}, err
+	}
+
+	if err := checkPages(name, off, count, int64(len(b.data))); err != nil {
+		return BlobInfo{}, err
+	}
+
+	buf := append([]byte(nil), b.data...)
+	copy(buf[off:off+count], make([]byte, count))
+
+	return m.store(name, PageBlob, buf, b.props()), nil
+}
+
+// Grow or shrink a page blob to size bytes
+func (m *MemBackend) ResizePages(ctx context.Context, name string, size int64, match string) (BlobInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, err := m.findType(name, PageBlob)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	if err := m.check(name, match); err != nil {
+		return BlobInfo{}, err
+	}
+
+	if err := checkPages(name, 0, size, size); err != nil {
+		return BlobInfo{}, err
+	}
+
+	buf := make([]byte, size)
+	copy(buf, b.data)
+
+	return m.store(name, PageBlob, buf, b.props()), nil
+}
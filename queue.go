@@ -0,0 +1,178 @@
+// Copyright (c) 2020 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Event Grid blob events delivered through an Azure storage queue, as an EventSource
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+const (
+	queueVersion = "2019-12-12"    // Queue service REST API version
+	queueBatch   = 32              // Most messages fetched at once, the service maximum
+	queueHide    = 60              // Seconds a fetched message is hidden from other readers
+	queuePoll    = 2 * time.Second // Wait between fetches of an empty queue
+
+	blobCreated = "Microsoft.Storage.BlobCreated"
+	blobDeleted = "Microsoft.Storage.BlobDeleted"
+)
+
+// Reads blob events for one container from a storage queue subscribed to Event Grid
+type QueueSource struct {
+	pipeline  pipeline.Pipeline
+	queue     url.URL // `https://account.queue.core.windows.net/queue`
+	container string  // Events for other containers are dropped
+}
+
+// A message as returned by Get Messages
+type queueMessage struct {
+	ID      string `xml:"MessageId"`
+	Receipt string `xml:"PopReceipt"`
+	Text    string `xml:"MessageText"`
+}
+
+// An Event Grid event, only the fields we need
+type gridEvent struct {
+	Type    string `json:"eventType"`
+	Subject string `json:"subject"` // `/blobServices/default/containers/c/blobs/a/b`
+}
+
+// Create a new source reading the queue at queue, authenticated by p
+func NewQueueSource(p pipeline.Pipeline, queue url.URL, container string) *QueueSource {
+	return &QueueSource{pipeline: p, queue: queue, container: container}
+}
+
+// Send a request to the queue service, returns the body of a successful response
+func (q *QueueSource) do(ctx context.Context, method string, u url.URL) ([]byte, error) {
+	req, err := pipeline.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", queueVersion)
+
+	resp, err := q.pipeline.Do(ctx, nil, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Response().Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Response().Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if code := resp.Response().StatusCode; code < 200 || code > 299 {
+		return nil, errors.New("queue request failed - " + resp.Response().Status)
+	}
+
+	return body, nil
+}
+
+// Wait for the next blob events, deleting their messages from the queue
+func (q *QueueSource) Next(ctx context.Context) ([]Event, error) {
+	for {
+		u := q.queue
+		u.Path += "/messages"
+		u.RawQuery = url.Values{
+			"numofmessages":     {strconv.Itoa(queueBatch)},
+			"visibilitytimeout": {strconv.Itoa(queueHide)},
+		}.Encode()
+
+		body, err := q.do(ctx, http.MethodGet, u)
+		if err != nil {
+			return nil, err
+		}
+
+		var list struct {
+			Messages []queueMessage `xml:"QueueMessage"`
+		}
+		err = xml.Unmarshal(body, &list)
+		if err != nil {
+			return nil, errors.New("could not decode queue messages - " + err.Error())
+		}
+
+		var events []Event
+		for _, msg := range list.Messages {
+			events = append(events, q.events(msg.Text)...)
+
+			// The tree is rebuilt by listing on restart, events need not outlive us
+			u := q.queue
+			u.Path += "/messages/" + msg.ID
+			u.RawQuery = url.Values{"popreceipt": {msg.Receipt}}.Encode()
+
+			_, err = q.do(ctx, http.MethodDelete, u)
+			if err != nil {
+				return events, err
+			}
+		}
+
+		if len(events) > 0 {
+			return events, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(queuePoll):
+		}
+	}
+}
+
+// Decode the events in a message for our container, anything else is dropped
+func (q *QueueSource) events(text string) []Event {
+	// Event Grid encodes message text in base64
+	raw, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		raw = []byte(text)
+	}
+
+	// Messages hold a single event or, from some subscriptions, an array of them
+	var grid []gridEvent
+	if json.Unmarshal(raw, &grid) != nil {
+		var one gridEvent
+		if json.Unmarshal(raw, &one) != nil {
+			return nil
+		}
+		grid = []gridEvent{one}
+	}
+
+	var events []Event
+	for _, ge := range grid {
+		ev, ok := parseGridEvent(ge, q.container)
+		if ok {
+			events = append(events, ev)
+		}
+	}
+
+	return events
+}
+
+// Convert a blob created or deleted event within container into an Event
+func parseGridEvent(ge gridEvent, container string) (Event, bool) {
+	if ge.Type != blobCreated && ge.Type != blobDeleted {
+		return Event{}, false
+	}
+
+	prefix := "/blobServices/default/containers/" + container + "/blobs/"
+	if !strings.HasPrefix(ge.Subject, prefix) || ge.Subject == prefix {
+		return Event{}, false
+	}
+
+	return Event{
+		Name:    strings.TrimPrefix(ge.Subject, prefix),
+		Deleted: ge.Type == blobDeleted,
+	}, true
+}
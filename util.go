@@ -5,8 +5,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 )
 
 // Maximum of two integrals
@@ -87,6 +89,41 @@ func intersect(a, b []string) []string {
 	return intersect
 }
 
+// Is every byte of p zero?
+func isZero(p []byte) bool {
+	for _, c := range p {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Parse rules of the form `.vhd=page,.log=append` into blob types by name suffix
+func parseTypeRules(s string) (map[string]BlobType, error) {
+	rules := make(map[string]BlobType)
+	if s == "" {
+		return rules, nil
+	}
+
+	for _, rule := range strings.Split(s, ",") {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New(`bad blob type rule "` + rule + `", want suffix=type`)
+		}
+
+		typ, err := ParseBlobType(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		rules[parts[0]] = typ
+	}
+
+	return rules, nil
+}
+
 // Print a tree, nicely
 func (t *File) String() string {
 	var descend func(depth uint64, t *File) string
@@ -98,9 +135,9 @@ func (t *File) String() string {
 			s += "\t"
 		}
 
-		s += t.name
+		s += t.Name()
 
-		if t.name != "/" && t.dir {
+		if t.Name() != "/" && t.dir {
 			s += "/"
 		}
 
@@ -108,7 +145,7 @@ func (t *File) String() string {
 
 		depth++
 
-		for _, child := range t.Children {
+		for _, child := range t.children() {
 			s += descend(depth, child)
 		}
 
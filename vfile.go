@@ -48,6 +48,16 @@ func (vf VFile) Mode() os.FileMode {
 	return vf.File.Mode()
 }
 
+// Returns the owner of the file
+func (vf VFile) Uid() string {
+	return vf.File.Uid()
+}
+
+// Returns the group of the file, its blob type
+func (vf VFile) Gid() string {
+	return vf.File.Gid()
+}
+
 // Returns the time of the last modification of the file
 func (vf VFile) ModTime() time.Time {
 	return vf.File.ModTime()
@@ -62,8 +72,3 @@ func (vf VFile) Sys() interface{} {
 func (vf VFile) Stat() os.FileInfo {
 	return vf.File.Stat()
 }
-
-// If we are a directory, avoid calling ReadAt()?
-func (vf VFile) Readdir(n int) ([]os.FileInfo, error) {
-	return vf.File.Readdir(n)
-}